@@ -15,25 +15,71 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
 )
 
-func (this *RequestContext) safelyUpdateConfig(path string) {
+// git trailer of minor edits, which could be hidden in history and recent changes
+const MINOR_TRAILER = "Minor-edit: yes"
+
+// a save posted as json instead of a form
+type editRequest struct {
+	Body    string `json:"body"`
+	Version string `json:"version"` // the version the edit is based on
+	Message string `json:"message"`
+	Minor   bool   `json:"minor"`
+}
+
+// the option file of a page, e.g. xx.md.option.json
+func optionFile(fp string) string {
 	if len(wikiConfig.optext) == 0 {
-		path = path + ".option.json"
-	} else {
-		path = path + wikiConfig.optext
+		return fp + ".option.json"
+	}
+	return fp + wikiConfig.optext
+}
+
+// files bound to a page, which should go together with the page itself
+func sidecarFiles(fp string) []string {
+	return []string{optionFile(fp), fp + ".head", fp + ".tail"}
+}
+
+// the redirect target left in the option file by a page move, empty if none
+func (this *Wiki) getRedirect(fp string) string {
+	option, err := ioutil.ReadFile(this.file(optionFile(fp)))
+	if err != nil {
+		return ""
+	}
+	var custom_option = CustomOption{}
+	err = json.Unmarshal(option, &custom_option)
+	if err != nil {
+		return ""
+	}
+	// only local redirection is allowed
+	if !strings.HasPrefix(custom_option.Redirect, "/") || strings.HasPrefix(custom_option.Redirect, "//") {
+		return ""
 	}
+	return custom_option.Redirect
+}
+
+func (this *RequestContext) safelyUpdateConfig(path string) {
+	path = optionFile(path)
 	if wikiConfig.verbose {
 		log.Print("[ DEBUG ] Read option, file path " + path)
 	}
-	option, err := ioutil.ReadFile(path)
+	option, err := ioutil.ReadFile(this.wiki.file(path))
 	if err != nil {
 		return
 	}
+	this.applyOption(option)
+}
+
+// apply the custom view options of a page
+func (this *RequestContext) applyOption(option []byte) {
 	var custom_option = CustomOption{}
-	err = json.Unmarshal(option, &custom_option)
+	err := json.Unmarshal(option, &custom_option)
 	if err != nil {
 		return
 	}
@@ -74,56 +120,39 @@ func (this *RequestContext) saveOption(option CustomOption) error {
 	w := *this.res
 	w.Header().Set("Content-Type", "application/json")
 
-	var filePath string
 	if !strings.HasSuffix(this.path, ".md") {
 		this.path += ".md"
 	}
-	if len(wikiConfig.optext) == 0 {
-		filePath = this.path + ".option.json"
-	} else {
-		filePath = this.path + wikiConfig.optext
-	}
+	filePath := optionFile(this.path)
 	content, err := json.Marshal(option)
 	log.Print("[ DEBUG ] Save option, file path " + filePath)
-	err = ioutil.WriteFile(filePath, content, 0600)
+	err = ioutil.WriteFile(this.wiki.file(filePath), content, 0600)
 	return err
 }
 
 func (this *RequestContext) Update(action string) error {
-	var comment string
-	if _, err := os.Stat(this.path); err == nil {
-		// file exists
-		comment = "update " + this.path
-	} else {
-		comment = "upload to " + this.path
-	}
-	// extract the content from post
-	upload_content := []byte(this.req.FormValue("body"))
-
-	if vs := this.req.Form["body"]; len(vs) == 0 {
-		err := this.req.ParseMultipartForm(1048576 * 100)
-		if err != nil {
-			this.statusCode = http.StatusInternalServerError
-			return err
-		}
-		_, mh, err := this.req.FormFile("body")
-		if err != nil {
+	var upload_content []byte
+	var base, message string
+	var minor bool
+	if mediatype, _, _ := mime.ParseMediaType(this.req.Header.Get("Content-Type")); mediatype == "application/json" {
+		var edit editRequest
+		if err := json.NewDecoder(this.req.Body).Decode(&edit); err != nil {
 			this.statusCode = http.StatusBadRequest
 			return err
 		}
-		buffer := &bytes.Buffer{}
-		file, err := mh.Open()
+		upload_content = []byte(edit.Body)
+		base, message, minor = edit.Version, edit.Message, edit.Minor
+	} else {
+		var err error
+		upload_content, err = this.readBody()
 		if err != nil {
-			this.statusCode = http.StatusBadRequest
-			return err
-		}
-		defer file.Close()
-		if _, err = io.Copy(buffer, file); err != nil {
-			this.statusCode = http.StatusInternalServerError
 			return err
 		}
-		upload_content = buffer.Bytes()
+		base, message = this.req.FormValue("version"), this.req.FormValue("message")
+		minor = isFormTrue(this.req.FormValue("minor"))
 	}
+	message = strings.TrimSpace(message)
+
 	if strings.HasSuffix(this.path, ".md") {
 		if bytes.Contains(upload_content, []byte("</xmp>")) {
 			w := *this.res
@@ -135,18 +164,44 @@ func (this *RequestContext) Update(action string) error {
 			return nil
 		}
 	}
+	// the editor posts the version it was opened at, changes committed since then are merged
+	if len(base) > 0 {
+		if version, err := this.wiki.resolveVersion(base); err != nil || len(version) == 0 {
+			this.statusCode = http.StatusBadRequest
+			if err == nil {
+				err = errors.New("version " + base + " not found")
+			}
+			return err
+		}
+	}
 	// save
 	if wikiConfig.verbose {
 		log.Printf("[ DEBUG ] try write to %s, %d bytes\n", this.path, len(upload_content))
 	}
-	err := saveAndCommit(this.path, upload_content, comment, this.gusername+"@"+this.ip, this.gmailaddr)
+	author, author_email := this.author()
+	merged, head, clean, err := this.wiki.mergeAndCommit(this.Branch, this.path, base, upload_content, message, minor, author, author_email)
 	if err != nil {
 		this.statusCode = http.StatusInternalServerError
 		return err
 	}
+	if !clean {
+		// send the conflict markers back to the editor, based on the latest version
+		w := *this.res
+		this.statusCode = http.StatusConflict
+		this.Content = template.HTML(merged)
+		this.Version = head
+		this.safelyUpdateConfig(this.path)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(this.statusCode)
+		return templates["edit"].Execute(w, this)
+	}
 	if action == "redirect" {
+		target := this.req.URL.Path
+		if len(this.Branch) > 0 {
+			target += "?branch=" + url.QueryEscape(this.Branch)
+		}
 		this.statusCode = http.StatusFound
-		http.Redirect(*this.res, this.req, this.req.URL.Path, this.statusCode)
+		http.Redirect(*this.res, this.req, target, this.statusCode)
 	} else {
 		w := *this.res
 		this.statusCode = http.StatusOK
@@ -156,14 +211,54 @@ func (this *RequestContext) Update(action string) error {
 	return nil
 }
 
+// a checkbox or flag posted in a form
+func isFormTrue(value string) bool {
+	switch value {
+	case "", "0", "false", "off":
+		return false
+	}
+	return true
+}
+
+// the posted content, from the body field or an uploaded file
+func (this *RequestContext) readBody() ([]byte, error) {
+	upload_content := []byte(this.req.FormValue("body"))
+
+	if vs := this.req.Form["body"]; len(vs) == 0 {
+		err := this.req.ParseMultipartForm(1048576 * 100)
+		if err != nil {
+			this.statusCode = http.StatusInternalServerError
+			return nil, err
+		}
+		_, mh, err := this.req.FormFile("body")
+		if err != nil {
+			this.statusCode = http.StatusBadRequest
+			return nil, err
+		}
+		buffer := &bytes.Buffer{}
+		file, err := mh.Open()
+		if err != nil {
+			this.statusCode = http.StatusBadRequest
+			return nil, err
+		}
+		defer file.Close()
+		if _, err = io.Copy(buffer, file); err != nil {
+			this.statusCode = http.StatusInternalServerError
+			return nil, err
+		}
+		upload_content = buffer.Bytes()
+	}
+	return upload_content, nil
+}
+
 func (this *RequestContext) View(version string) error {
 	var err error
 	var content []byte
 	if len(version) > 0 {
-		content, err = getFileOfVersion(this.path, version)
+		content, err = this.wiki.getFileOfVersion(this.path, version)
 	} else {
-		if _, err = os.Stat(this.path); err == nil {
-			content, err = ioutil.ReadFile(this.path)
+		if _, err = os.Stat(this.wiki.file(this.path)); err == nil {
+			content, err = ioutil.ReadFile(this.wiki.file(this.path))
 		} else {
 			// file not exist, but never mind, set err = nil to just continue edit a new file
 			err = nil
@@ -174,8 +269,8 @@ func (this *RequestContext) View(version string) error {
 	}
 	this.Content = template.HTML(content)
 
-	custom_view_head, errh := ioutil.ReadFile(this.path + ".head")
-	custom_view_tail, errt := ioutil.ReadFile(this.path + ".tail")
+	custom_view_head, errh := ioutil.ReadFile(this.wiki.file(this.path + ".head"))
+	custom_view_tail, errt := ioutil.ReadFile(this.wiki.file(this.path + ".tail"))
 	if errh == nil && errt == nil {
 		var w = *this.res
 		w.Write(custom_view_head)
@@ -184,7 +279,7 @@ func (this *RequestContext) View(version string) error {
 	} else {
 		this.safelyUpdateConfig(this.path)
 
-		this.CommitEntries, _ = getHistory(this.path, 1)
+		this.CommitEntries, _, _ = this.wiki.getHistory(this.path, 1, this.Branch, historyFilter{})
 
 		err := templates["view"].Execute(*this.res, this)
 		if err != nil {
@@ -196,7 +291,7 @@ func (this *RequestContext) View(version string) error {
 func (this *RequestContext) Listdir() error {
 
 	w := *this.res
-	dirfile, err := SafeOpen(this.path, "")
+	dirfile, err := SafeOpen(this.wiki.file(this.path), "")
 	if err != nil {
 		this.statusCode = http.StatusBadRequest
 		return err
@@ -206,15 +301,15 @@ func (this *RequestContext) Listdir() error {
 
 	this.safelyUpdateConfig(this.path)
 
-	if this.Title == wikiConfig.title {
+	if this.Title == this.wiki.Title {
 		this.Title = this.path
 	}
 	this.DirEntries = make([]DirEntry, 0, 16)
-	fpstat, err := os.Stat(this.path)
+	fpstat, err := os.Stat(this.wiki.file(this.path))
 	if err != nil {
 		return err
 	}
-	fpurl := url.URL{Path: path.Join("/", this.path, "..")}
+	fpurl := url.URL{Path: this.wiki.link(path.Join("/", this.path, ".."))}
 	this.DirEntries = append(this.DirEntries, DirEntry{Name: "..", IsDir: true, Urlpath: fpurl.String(), Size: fpstat.Size(), ModTime: fpstat.ModTime()})
 
 	for {
@@ -223,7 +318,7 @@ func (this *RequestContext) Listdir() error {
 			break
 		}
 		for _, d := range dirs {
-			dirurl := url.URL{Path: path.Join("/", this.path, d.Name())}
+			dirurl := url.URL{Path: this.wiki.link(path.Join("/", this.path, d.Name()))}
 			dirurls := dirurl.String()
 			if strings.HasSuffix(dirurls, ".md") {
 				dirurls = strings.TrimSuffix(dirurls, ".md")
@@ -233,31 +328,180 @@ func (this *RequestContext) Listdir() error {
 	}
 	return templates["listdir"].Execute(w, this)
 }
-func (this *RequestContext) History(histsize int) error {
-	commit_history, err := getHistory(this.path, histsize)
-	if err != nil || commit_history == nil || len(commit_history) == 0 {
-		if err != nil {
-			return err
-		} else {
-			return errors.New("No commit history found for " + this.path)
+
+// list a directory as it was at version, links keep query so that browsing stays at that version
+func (this *RequestContext) ListdirOfVersion(version string, query string) error {
+	repo, err := this.wiki.repo.Open()
+	if err != nil {
+		this.statusCode = http.StatusInternalServerError
+		return err
+	}
+	defer this.wiki.repo.Release(repo)
+
+	commit, err := getCommitOfVersion(repo, version)
+	if err != nil || commit == nil {
+		this.statusCode = http.StatusNotFound
+		if err == nil {
+			err = errors.New("version " + version + " not found")
+		}
+		return err
+	}
+	defer commit.Free()
+
+	tree, err := getDirTree(repo, commit, this.path)
+	if err != nil || tree == nil {
+		this.statusCode = http.StatusNotFound
+		if err == nil {
+			err = errors.New(this.path + " is not a directory at version " + version)
+		}
+		return err
+	}
+	defer tree.Free()
+
+	odb, err := repo.Odb()
+	if err != nil {
+		this.statusCode = http.StatusInternalServerError
+		return err
+	}
+	defer odb.Free()
+
+	w := *this.res
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	this.safelyUpdateConfig(this.path)
+	if this.Title == this.wiki.Title {
+		this.Title = this.path
+	}
+
+	// there is no mtime in git, use the time of the last change from the path index, or the time of the commit
+	modtime := commit.Committer().When
+	lastChanges, _ := this.wiki.repo.index.LastChanges(repo, this.path, commit.Id().String())
+	parent := path.Join("/", this.path, "..")
+	if parent != "/" {
+		parent += "/"
+	}
+	this.DirEntries = []DirEntry{{Name: "..", IsDir: true, Urlpath: this.wiki.link(parent) + "?" + query, ModTime: modtime}}
+
+	for i := uint64(0); i < tree.EntryCount(); i++ {
+		entry := tree.EntryByIndex(i)
+		isdir := entry.Type == git.ObjectTree
+		dirurl := url.URL{Path: this.wiki.link(path.Join("/", this.path, entry.Name))}
+		dirurls := dirurl.String()
+		if isdir {
+			dirurls += "/"
+		} else if strings.HasSuffix(dirurls, ".md") {
+			dirurls = strings.TrimSuffix(dirurls, ".md")
+		}
+		var size uint64
+		if !isdir {
+			size, _, _ = odb.ReadHeader(entry.Id)
+		}
+		entrytime, ok := lastChanges[entry.Name]
+		if !ok {
+			entrytime = modtime
 		}
+		this.DirEntries = append(this.DirEntries, DirEntry{Name: entry.Name, IsDir: isdir, Urlpath: dirurls + "?" + query, Size: int64(size), ModTime: entrytime})
+	}
+	return templates["listdir"].Execute(w, this)
+}
+
+// the tree of directory dir in commit, nil if it is not a directory there
+func getDirTree(repo *git.Repository, commit *git.Commit, dir string) (*git.Tree, error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	dir = strings.Trim(dir, "/")
+	if len(dir) == 0 {
+		return tree, nil
+	}
+	defer tree.Free()
+
+	entry, err := tree.EntryByPath(dir)
+	if err != nil || entry.Type != git.ObjectTree {
+		return nil, nil
+	}
+	return repo.LookupTree(entry.Id)
+}
+
+func (this *Wiki) isDirOfVersion(dir string, version string) bool {
+	repo, err := this.repo.Open()
+	if err != nil {
+		return false
+	}
+	defer this.repo.Release(repo)
+
+	commit, err := getCommitOfVersion(repo, version)
+	if err != nil || commit == nil {
+		return false
+	}
+	defer commit.Free()
+
+	tree, err := getDirTree(repo, commit, dir)
+	if err != nil || tree == nil {
+		return false
+	}
+	tree.Free()
+	return true
+}
+
+// a page of history, the next page starts after the last entry
+type historyPage struct {
+	Path    string
+	Entries []CommitEntry
+	Next    string `json:",omitempty"`
+}
+
+func (this *RequestContext) History(histsize int, filter historyFilter, format string) error {
+	if format != "" && format != "json" {
+		this.statusCode = http.StatusBadRequest
+		return errors.New("unknown format " + format + ", should be json")
+	}
+	commit_history, more, err := this.wiki.getHistory(this.path, histsize, this.Branch, filter)
+	if err != nil {
+		return err
+	}
+	filtered := filter != historyFilter{}
+	if len(commit_history) == 0 && !filtered {
+		return errors.New("No commit history found for " + this.path)
+	}
+	var next string
+	if more {
+		next = commit_history[len(commit_history)-1].Id
+	}
+
+	if format == "json" {
+		w := *this.res
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(historyPage{Path: this.path, Entries: commit_history, Next: next})
+	}
+
+	this.HideMinor = filter.HideMinor
+	this.Author = filter.Author
+	this.After = filter.After
+	if len(next) > 0 {
+		// the same filters for the older versions
+		query := this.req.URL.Query()
+		query.Set("after", next)
+		this.NextLink = "?" + query.Encode()
 	}
 	this.safelyUpdateConfig(this.path)
-	if this.Title == wikiConfig.title {
+	if this.Title == this.wiki.Title {
 		this.Title = this.path
 	}
 	this.CommitEntries = commit_history
 	return templates["history"].Execute(*this.res, this)
 }
+
 func (this *RequestContext) Edit(version string) error {
 	var content []byte
 	var err error
 
 	if len(version) > 0 {
-		content, err = getFileOfVersion(this.path, version)
+		content, err = this.wiki.getFileOfVersion(this.path, version)
 	} else {
-		if _, err = os.Stat(this.path); err == nil {
-			content, err = ioutil.ReadFile(this.path)
+		if _, err = os.Stat(this.wiki.file(this.path)); err == nil {
+			content, err = ioutil.ReadFile(this.wiki.file(this.path))
 		} else {
 			// file not exist, but never mind, set err = nil to just continue edit a new file
 			err = nil
@@ -276,344 +520,1990 @@ func (this *RequestContext) Upload() error {
 	this.safelyUpdateConfig(this.path)
 	return templates["upload"].Execute(w, this)
 }
-func (this *RequestContext) Diff(versions []string) error {
-	if len(versions) != 2 {
-		return errors.New("Bad params for diff, please select exactly TWO versions!")
-	}
-	w := *this.res
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	this.safelyUpdateConfig(this.path)
 
-	content, err := getFileDiff(this.path, versions)
-	if err != nil {
-		return err
+// extract a zip or tar(.gz) archive into the directory, all files in one commit
+func (this *RequestContext) UploadArchive() error {
+	dir := strings.Trim(this.path, "/")
+	if stat, err := os.Stat(this.wiki.file(this.path)); err == nil && !stat.IsDir() {
+		this.statusCode = http.StatusBadRequest
+		return errors.New(this.path + " is not a directory")
 	}
-	this.Content = template.HTML(*content)
+	content, err := this.readBody()
 	if err != nil {
 		return err
 	}
-	this.Versions = versions
-	return templates["diff"].Execute(w, this)
-}
-
-//save md file and git commit, for .md
-func saveAndCommit(fp string, content []byte, comment string, author string, author_gmail string) error {
-	var err error
-
-	err = os.MkdirAll(path.Dir(fp), 0700)
+	entries, err := this.wiki.readArchive(content, dir)
 	if err != nil {
+		this.statusCode = http.StatusBadRequest
 		return err
 	}
-
-	err = ioutil.WriteFile(fp, content, 0600)
-	if err != nil {
-		return err
+	comment := strings.TrimSpace(this.req.FormValue("message"))
+	if len(comment) == 0 {
+		comment = fmt.Sprintf("upload %d files to /%s", len(entries), dir)
 	}
-
-	repo, err := git.OpenRepository(".")
-	if err != nil {
-		return err
+	comment = buildCommitMessage(comment, isFormTrue(this.req.FormValue("minor")))
+	if wikiConfig.verbose {
+		log.Printf("[ DEBUG ] try write %d files from archive to /%s\n", len(entries), dir)
 	}
-	defer repo.Free()
-
-	index, err := repo.Index()
+	author, author_email := this.author()
+	err = this.wiki.saveArchiveAndCommit(entries, comment, author, author_email)
 	if err != nil {
+		this.statusCode = http.StatusConflict
 		return err
 	}
-	defer index.Free()
+	w := *this.res
+	this.statusCode = http.StatusOK
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("success"))
+	return nil
+}
 
-	err = index.AddByPath(fp)
-	if err != nil {
-		return err
+// download the directory at version as a zip or tar.gz archive, streamed from git objects
+func (this *RequestContext) Archive(format string, version string) error {
+	if format != ARCHIVE_ZIP && format != ARCHIVE_TARGZ {
+		this.statusCode = http.StatusBadRequest
+		return errors.New("unknown archive format " + format + ", should be zip or tar.gz")
 	}
-
-	treeId, err := index.WriteTree()
+	repo, err := this.wiki.repo.Open()
 	if err != nil {
+		this.statusCode = http.StatusInternalServerError
 		return err
 	}
+	defer this.wiki.repo.Release(repo)
 
-	err = index.Write()
-	if err != nil {
+	commit, err := getCommitOfVersion(repo, version)
+	if err != nil || commit == nil {
+		this.statusCode = http.StatusNotFound
+		if err == nil {
+			err = errors.New("nothing committed yet")
+		}
 		return err
 	}
-
-	tree, err := repo.LookupTree(treeId)
-	if err != nil {
+	defer commit.Free()
+	dir := strings.Trim(this.path, "/")
+	tree, err := getDirTree(repo, commit, dir)
+	if err != nil || tree == nil {
+		this.statusCode = http.StatusNotFound
+		if err == nil {
+			err = errors.New("/" + dir + " is not a directory at version " + version)
+		}
 		return err
 	}
+	defer tree.Free()
 
-	sig := &git.Signature{
-		Name:  author,
-		Email: author_gmail,
-		When:  time.Now(),
+	name := path.Base("/" + dir)
+	if name == "/" {
+		name = "wiki"
 	}
+	name += "-" + commit.Id().String()[:11]
 
-	currentBranch, err := repo.Head()
-	if err == nil && currentBranch != nil {
-		currentTip, err2 := repo.LookupCommit(currentBranch.Target())
-		if err2 != nil {
-			return err2
-		}
-		_, err = repo.CreateCommit("HEAD", sig, sig, comment, tree, currentTip)
+	w := *this.res
+	if format == ARCHIVE_ZIP {
+		w.Header().Set("Content-Type", "application/zip")
 	} else {
-		_, err = repo.CreateCommit("HEAD", sig, sig, comment, tree)
+		w.Header().Set("Content-Type", "application/gzip")
 	}
-
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + "." + format}))
+	this.statusCode = http.StatusOK
+	err = this.wiki.writeTreeArchive(w, format, repo, tree, dir, name+"/", commit.Committer().When)
 	if err != nil {
-		return err
+		// too late for an error page, the archive is just truncated
+		log.Printf("[ WARN ] archive of /%s at %s failed: %v", dir, version, err)
 	}
 	return nil
 }
-func getFileOfVersion(fileName string, version string) ([]byte, error) {
-	var err error
-	var commit *git.Commit
 
-	repo, err := git.OpenRepository(".")
-	if err != nil {
-		return nil, err
+func (this *RequestContext) Diff(versions []string) error {
+	if len(versions) != 2 {
+		return errors.New("Bad params for diff, please select exactly TWO versions!")
 	}
-	defer repo.Free()
-
-	vl := len(version)
+	w := *this.res
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	this.safelyUpdateConfig(this.path)
 
-	if vl < 4 || vl > 40 {
-		return nil, fmt.Errorf("version length should be in range [4, 40], provided %d", vl)
+	// diff the resolved commits, versions are kept as requested for the template
+	commits := make([]string, len(versions))
+	for i, version := range versions {
+		commit, err := this.wiki.resolveVersion(version)
+		if err != nil {
+			return err
+		}
+		if len(commit) == 0 {
+			this.statusCode = http.StatusNotFound
+			return errors.New("version " + version + " not found")
+		}
+		commits[i] = commit
 	}
 
-	oid, err := git.NewOid(version)
-	if err == nil {
-		// TODO: git2go seems haven't implemented git_commit_lookup_prefix API, so now this lookup only works for full-width 40 hex version
-		commit, err = repo.LookupCommit(oid)
-
-		if err == nil && commit != nil {
-			str, err := getCommitFile(repo, commit, fileName)
-			if err != nil {
-				return nil, err
-			}
-
-			var s []byte
-			if str != nil {
-				s = []byte(*str)
-			}
-			return s, nil
+	this.Versions = versions
+	if len(this.DiffMode) > 0 {
+		content, err := this.wiki.renderDiff(this.path, commits, this.DiffMode)
+		if err != nil {
+			return err
+		}
+		this.Content = content
+		if this.DiffMode == DIFF_MODE_RENDERED {
+			return templates["diffrendered"].Execute(w, this)
 		}
+		return templates["diff"].Execute(w, this)
 	}
 
-	// if the commit version id not as long as 40 hexchars, we just loop from head to the initial commit, looking for such a commit matching prefix
-	currentBranch, err := repo.Head()
+	content, err := this.wiki.getFileDiff(this.path, commits)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer currentBranch.Free()
-
-	commit, err = repo.LookupCommit(currentBranch.Target())
+	this.Content = template.HTML(*content)
 	if err != nil {
-		return nil, err
-	}
-
-	for commit != nil {
-		if commit.Id().String()[0:len(version)] == version {
-			str, err := getCommitFile(repo, commit, fileName)
-			if err != nil {
-				return nil, err
-			}
-
-			var s []byte
-			if str != nil {
-				s = []byte(*str)
-			}
-			return s, nil
-		}
-		commit = commit.Parent(0)
+		return err
 	}
-	return nil, nil
+	return templates["diff"].Execute(w, this)
 }
 
-// private implementation, starts with lower case
-func getFileDiff(fileName string, diff_versions []string) (*string, error) {
-	// only diff .md file
-	// diff folder is not supported  or TODO?
-	var err error
-
+func (this *RequestContext) Blame(version string) error {
+	if len(version) == 0 {
+		version = this.wiki.getHeadVersion()
+	}
+	blame_lines, err := this.wiki.getBlame(this.path, version)
+	if err != nil {
+		return err
+	}
+	if blame_lines == nil {
+		this.statusCode = http.StatusNotFound
+		return errors.New("file " + this.path + " not found at version " + version)
+	}
+	w := *this.res
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	this.safelyUpdateConfig(this.path)
+	if this.Title == this.wiki.Title {
+		this.Title = this.path
+	}
+	this.BlameLines = blame_lines
+	return templates["blame"].Execute(w, this)
+}
+
+// check whether the page could be deleted (or moved away), statusCode is set if not
+func (this *RequestContext) checkDeletable() error {
+	if isReservedPath(this.path) {
+		this.statusCode = http.StatusForbidden
+		return errors.New("deletion of " + this.path + " is not allowed")
+	}
+	fpstat, err := os.Stat(this.wiki.file(this.path))
+	if err != nil {
+		this.statusCode = http.StatusNotFound
+		return errors.New("file " + this.path + " does not exist")
+	}
+	if fpstat.IsDir() {
+		this.statusCode = http.StatusBadRequest
+		return errors.New(this.path + " is a directory, only files can be deleted")
+	}
+	return nil
+}
+
+func (this *RequestContext) ConfirmDelete() error {
+	if err := this.checkDeletable(); err != nil {
+		return err
+	}
+	w := *this.res
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	this.safelyUpdateConfig(this.path)
+	if this.Title == this.wiki.Title {
+		this.Title = this.path
+	}
+	return templates["delete"].Execute(w, this)
+}
+
+func (this *RequestContext) Delete(action string) error {
+	if err := this.checkDeletable(); err != nil {
+		return err
+	}
+	files := append([]string{this.path}, sidecarFiles(this.path)...)
+	author, author_email := this.author()
+	err := this.wiki.removeAndCommit(files, "delete "+this.path, author, author_email)
+	if err != nil {
+		this.statusCode = http.StatusInternalServerError
+		return err
+	}
+	if action == "redirect" {
+		// go back to the folder containing the deleted file
+		dir := path.Dir("/" + this.path)
+		if dir != "/" {
+			dir += "/"
+		}
+		this.statusCode = http.StatusFound
+		http.Redirect(*this.res, this.req, this.wiki.link(dir), this.statusCode)
+	} else {
+		w := *this.res
+		this.statusCode = http.StatusOK
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("success"))
+	}
+	return nil
+}
+
+func (this *RequestContext) Move(newpath string, stub bool) error {
+	if err := this.checkDeletable(); err != nil {
+		return err
+	}
+	target := strings.TrimPrefix(path.Clean("/"+newpath), "/")
+	if strings.HasSuffix(this.path, ".md") && !strings.HasSuffix(target, ".md") {
+		target += ".md"
+	}
+	if len(target) == 0 || target == this.path {
+		this.statusCode = http.StatusBadRequest
+		return errors.New("bad new path for move: " + newpath)
+	}
+	if len(this.wiki.forbiddenPath(target)) > 0 || isReservedPath(target) {
+		this.statusCode = http.StatusForbidden
+		return errors.New("move to " + target + " is not allowed")
+	}
+	to := append([]string{target}, sidecarFiles(target)...)
+	for _, fp := range to {
+		if _, err := os.Stat(this.wiki.file(fp)); err == nil {
+			this.statusCode = http.StatusConflict
+			return errors.New(fp + " already exists, please choose another path")
+		}
+	}
+
+	targeturl := url.URL{Path: "/" + strings.TrimSuffix(target, ".md")}
+	var stubfile string
+	var stubcontent []byte
+	if stub {
+		var err error
+		stubfile = optionFile(this.path)
+		stubcontent, err = json.Marshal(CustomOption{Redirect: targeturl.String()})
+		if err != nil {
+			this.statusCode = http.StatusInternalServerError
+			return err
+		}
+	}
+
+	from := append([]string{this.path}, sidecarFiles(this.path)...)
+	author, author_email := this.author()
+	err := this.wiki.moveAndCommit(from, to, stubfile, stubcontent, "move "+this.path+" to "+target, author, author_email)
+	if os.IsExist(err) {
+		// created by another request in the meantime
+		this.statusCode = http.StatusConflict
+		return err
+	} else if err != nil {
+		this.statusCode = http.StatusInternalServerError
+		return err
+	}
+	this.statusCode = http.StatusFound
+	http.Redirect(*this.res, this.req, this.wiki.link(targeturl.String()), this.statusCode)
+	return nil
+}
+
+func (this *RequestContext) Revert(version string) error {
+	repo, err := this.wiki.repo.Open()
+	if err != nil {
+		this.statusCode = http.StatusInternalServerError
+		return err
+	}
+	defer this.wiki.repo.Release(repo)
+
+	commit, err := getCommitOfVersion(repo, version)
+	if err != nil || commit == nil {
+		this.statusCode = http.StatusNotFound
+		if err == nil {
+			err = errors.New("version " + version + " not found")
+		}
+		return err
+	}
+	defer commit.Free()
+	fullversion := commit.Id().String()
+
+	// when the page has been deleted, the url may not tell whether it is a .md page
+	candidates := []string{this.path}
+	if _, err := os.Stat(this.wiki.file(this.path)); err != nil && !strings.HasSuffix(this.path, ".md") {
+		candidates = append(candidates, this.path+".md")
+	}
+	var content []byte
+	for _, fp := range candidates {
+		content, err = this.wiki.getFileOfVersion(fp, fullversion)
+		if err != nil {
+			return err
+		}
+		if content != nil {
+			this.path = fp
+			break
+		}
+	}
+
+	if isReservedPath(this.path) {
+		this.statusCode = http.StatusForbidden
+		return errors.New("revert of " + this.path + " is not allowed")
+	}
+
+	comment := "revert " + this.path + " to " + fullversion[:11]
+	author, author_email := this.author()
+	if content == nil {
+		// the page does not exist at that version, revert means delete
+		if _, err := os.Stat(this.wiki.file(this.path)); err != nil {
+			this.statusCode = http.StatusNotFound
+			return errors.New(this.path + " exists neither now nor at version " + version)
+		}
+		files := append([]string{this.path}, sidecarFiles(this.path)...)
+		err = this.wiki.removeAndCommit(files, comment, author, author_email)
+	} else {
+		err = this.wiki.saveAndCommit(this.path, content, comment, author, author_email)
+	}
+	if err != nil {
+		this.statusCode = http.StatusInternalServerError
+		return err
+	}
+	this.statusCode = http.StatusFound
+	http.Redirect(*this.res, this.req, this.req.URL.Path, this.statusCode)
+	return nil
+}
+
+// bring back a deleted page, as of version or the last version before it was deleted
+func (this *RequestContext) Restore(version string) error {
+	// the url may not tell whether it is a .md page
+	candidates := []string{this.path}
+	if !strings.HasSuffix(this.path, ".md") {
+		candidates = append(candidates, this.path+".md")
+	}
+	for _, fp := range candidates {
+		if _, err := os.Stat(this.wiki.file(fp)); err == nil {
+			this.statusCode = http.StatusConflict
+			return errors.New(fp + " already exists, nothing to restore")
+		}
+	}
+
+	var content []byte
+	var err error
+	if len(version) == 0 {
+		page := strings.TrimSuffix(this.path, ".md")
+		deleted, err := this.wiki.getDeletedPages(page)
+		if err != nil {
+			this.statusCode = http.StatusInternalServerError
+			return err
+		}
+		for _, entry := range deleted {
+			if entry.Path == page+".md" {
+				this.path = entry.Path
+				version = entry.LastVersion
+				break
+			}
+		}
+		if len(version) == 0 {
+			this.statusCode = http.StatusNotFound
+			return errors.New("no deleted page found at " + this.path)
+		}
+		content, err = this.wiki.getFileOfVersion(this.path, version)
+		if err != nil {
+			return err
+		}
+	} else {
+		fullversion, err := this.wiki.resolveVersion(version)
+		if err != nil {
+			return err
+		}
+		if len(fullversion) == 0 {
+			this.statusCode = http.StatusNotFound
+			return errors.New("version " + version + " not found")
+		}
+		version = fullversion
+		for _, fp := range candidates {
+			content, err = this.wiki.getFileOfVersion(fp, version)
+			if err != nil {
+				return err
+			}
+			if content != nil {
+				this.path = fp
+				break
+			}
+		}
+	}
+	if content == nil {
+		this.statusCode = http.StatusNotFound
+		return errors.New(this.path + " does not exist at version " + version)
+	}
+	if isReservedPath(this.path) {
+		this.statusCode = http.StatusForbidden
+		return errors.New("restore of " + this.path + " is not allowed")
+	}
+
+	// the option/head/tail files come back in the same commit
+	fps, contents := []string{this.path}, [][]byte{content}
+	for _, fp := range sidecarFiles(this.path) {
+		sidecar, err := this.wiki.getFileOfVersion(fp, version)
+		if err != nil {
+			this.statusCode = http.StatusInternalServerError
+			return err
+		}
+		if sidecar != nil {
+			fps, contents = append(fps, fp), append(contents, sidecar)
+		}
+	}
+
+	author, author_email := this.author()
+	err = this.wiki.saveFilesAndCommit(fps, contents, "restore "+this.path+" from "+version[:11], author, author_email)
+	if err != nil {
+		this.statusCode = http.StatusInternalServerError
+		return err
+	}
+	pageurl := url.URL{Path: this.wiki.link("/" + strings.TrimSuffix(this.path, ".md"))}
+	this.statusCode = http.StatusFound
+	http.Redirect(*this.res, this.req, pageurl.String(), this.statusCode)
+	return nil
+}
+
+// fold a draft branch into the current branch, then the draft branch is deleted
+func (this *RequestContext) MergeBranch(branch string) error {
+	if !git.ReferenceIsValidName("refs/heads/"+branch) || this.wiki.isHeadBranch(branch) {
+		this.statusCode = http.StatusBadRequest
+		return errors.New("invalid draft branch " + branch)
+	}
+
+	err := this.wiki.repo.Write(func(repo *git.Repository, index *git.Index) error {
+		ref, err := repo.References.Lookup("refs/heads/" + branch)
+		if err != nil {
+			this.statusCode = http.StatusNotFound
+			return errors.New("draft branch " + branch + " not found")
+		}
+		defer ref.Free()
+		theirs := ref.Target()
+
+		current, err := headBranch(repo)
+		if err != nil {
+			return err
+		}
+		msg := "merge branch " + branch
+
+		head, err := repo.Head()
+		if err != nil {
+			// nothing published yet
+			if err = this.checkMergedFiles(repo, &git.Oid{}, theirs); err != nil {
+				return err
+			}
+			err = updateBranch(repo, current, theirs, msg)
+		} else {
+			defer head.Free()
+			ours := head.Target()
+			base, err2 := repo.MergeBase(ours, theirs)
+			if err2 != nil {
+				return err2
+			}
+			if err = this.checkMergedFiles(repo, base, theirs); err != nil {
+				return err
+			}
+			if base.Equal(ours) {
+				err = updateBranch(repo, current, theirs, msg)
+			} else if !base.Equal(theirs) {
+				// both have changed, theirs is already merged if base equals theirs
+				sig := this.authorSignature()
+				var conflicts []string
+				conflicts, err = mergeIntoHead(repo, ours, theirs, sig, msg)
+				if err == nil && len(conflicts) > 0 {
+					this.statusCode = http.StatusConflict
+					return errors.New("merge of branch " + branch + " conflicts in: " + strings.Join(conflicts, ", "))
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+		return ref.Delete()
+	})
+	if err != nil {
+		if this.statusCode == http.StatusOK {
+			this.statusCode = http.StatusInternalServerError
+		}
+		return err
+	}
+	this.wiki.requestPush()
+
+	this.statusCode = http.StatusFound
+	http.Redirect(*this.res, this.req, this.req.URL.Path, this.statusCode)
+	return nil
+}
+
+// the files changed on the draft branch since base are checked out by the merge,
+// so they go through the same checks as a push to the current branch
+func (this *RequestContext) checkMergedFiles(repo *git.Repository, base *git.Oid, theirs *git.Oid) error {
+	if err := this.wiki.checkPushedFiles(repo, base, theirs); err != nil {
+		this.statusCode = http.StatusForbidden
+		return err
+	}
+	return nil
+}
+
+func (this *RequestContext) RecentChanges(dir string, author string, size int, feed string, hideMinor bool) error {
+	if feed != "" && feed != "atom" && feed != "rss" {
+		this.statusCode = http.StatusBadRequest
+		return errors.New("unknown feed " + feed + ", should be atom or rss")
+	}
+	changes, err := this.wiki.getChanges(dir, author, size, hideMinor)
+	if err != nil {
+		this.statusCode = http.StatusInternalServerError
+		return err
+	}
+	this.path = dir
+	if this.Title == this.wiki.Title && len(dir) > 0 {
+		this.Title = dir
+	}
+	if feed == "atom" {
+		return this.writeAtom(changes)
+	} else if feed == "rss" {
+		return this.writeRSS(changes)
+	}
+
+	w := *this.res
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	this.Changes = changes
+	this.Author = author
+	this.HideMinor = hideMinor
+	return templates["changes"].Execute(w, this)
+}
+
+// pages under dir which were deleted and never came back
+func (this *RequestContext) ListDeleted(dir string) error {
+	deleted, err := this.wiki.getDeletedPages(dir)
+	if err != nil {
+		this.statusCode = http.StatusInternalServerError
+		return err
+	}
+	this.path = dir
+	if this.Title == this.wiki.Title && len(dir) > 0 {
+		this.Title = dir
+	}
+	w := *this.res
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	this.DeletedPages = deleted
+	return templates["deleted"].Execute(w, this)
+}
+
+// pages matching query from the search index, the most relevant first, as json for the search box
+func (this *RequestContext) Search(query string, limit int) error {
+	repo, err := this.wiki.repo.Open()
+	if err != nil {
+		this.statusCode = http.StatusInternalServerError
+		return err
+	}
+	defer this.wiki.repo.Release(repo)
+
+	terms := searchTerms(query)
+	results := []SearchResult{}
+	for _, hit := range this.wiki.repo.search.Search(repo, query, limit) {
+		u := url.URL{Path: this.wiki.link("/" + strings.TrimSuffix(hit.Path, ".md"))}
+		result := SearchResult{Path: u.String(), Title: hit.Title, Score: hit.Score}
+		if oid, err := git.NewOid(hit.Blob); err == nil {
+			if blob, err := repo.LookupBlob(oid); err == nil {
+				result.Match = searchSnippet(string(blob.Contents()), terms)
+				blob.Free()
+			}
+		}
+		results = append(results, result)
+	}
+
+	w := *this.res
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(results)
+}
+
+// everything changed by a single commit
+func (this *RequestContext) ShowCommit(version string) error {
+	commit, err := this.wiki.resolveVersion(version)
+	if err != nil {
+		return err
+	}
+	if len(commit) == 0 {
+		this.statusCode = http.StatusNotFound
+		return errors.New("version " + version + " not found")
+	}
+	entry, changes, err := this.wiki.getCommitDiff(commit)
+	if err != nil {
+		this.statusCode = http.StatusInternalServerError
+		return err
+	}
+	w := *this.res
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	this.Commit = entry
+	this.FileChanges = changes
+	return templates["commit"].Execute(w, this)
+}
+
+func (this *RequestContext) ListSnapshots() error {
+	snapshots, err := this.wiki.getSnapshots()
+	if err != nil {
+		this.statusCode = http.StatusInternalServerError
+		return err
+	}
+	w := *this.res
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	this.Snapshots = snapshots
+	return templates["snapshots"].Execute(w, this)
+}
+
+// tag the current state of the wiki with an annotated tag
+func (this *RequestContext) CreateSnapshot() error {
+	title := strings.TrimSpace(this.req.FormValue("title"))
+	if len(title) == 0 {
+		this.statusCode = http.StatusBadRequest
+		return errors.New("title required for snapshot")
+	}
+	name := strings.TrimSpace(this.req.FormValue("name"))
+	if len(name) == 0 {
+		name = snapshotName(title)
+	}
+	if !git.ReferenceIsValidName("refs/tags/" + name) {
+		this.statusCode = http.StatusBadRequest
+		return errors.New("invalid snapshot name " + name)
+	}
+
+	sig := this.authorSignature()
+	err := this.wiki.repo.Write(func(repo *git.Repository, index *git.Index) error {
+		head, err := repo.Head()
+		if err != nil {
+			this.statusCode = http.StatusBadRequest
+			return errors.New("nothing committed yet, no snapshot could be taken")
+		}
+		defer head.Free()
+
+		commit, err := repo.LookupCommit(head.Target())
+		if err != nil {
+			return err
+		}
+		defer commit.Free()
+
+		_, err = repo.Tags.Create(name, commit, sig, title+"\n")
+		if git.IsErrorCode(err, git.ErrExists) {
+			this.statusCode = http.StatusConflict
+			return errors.New("snapshot " + name + " already exists")
+		}
+		return err
+	})
+	if err != nil {
+		if this.statusCode == http.StatusOK {
+			this.statusCode = http.StatusInternalServerError
+		}
+		return err
+	}
+
+	this.statusCode = http.StatusFound
+	http.Redirect(*this.res, this.req, this.req.URL.Path+"?snapshots", this.statusCode)
+	return nil
+}
+
+var snapshotNameRe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// derive a tag name from the title, e.g. "Q3 handbook" to Q3-handbook
+func snapshotName(title string) string {
+	name := strings.Trim(snapshotNameRe.ReplaceAllString(title, "-"), "-.")
+	if len(name) == 0 {
+		name = "snapshot-" + time.Now().Format("20060102-150405")
+	}
+	return name
+}
+
+func (this *RequestContext) ListBranches() error {
+	branches, err := this.wiki.getBranches()
+	if err != nil {
+		this.statusCode = http.StatusInternalServerError
+		return err
+	}
+	w := *this.res
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	this.Branches = branches
+	return templates["branches"].Execute(w, this)
+}
+
+// three-way merge content edited from the base version with the current content at head
+// current is nil if the file does not exist, return the merged content and whether it is free of conflicts
+// repo is the handle of the write queue, so that head cannot move before the merged content is committed
+func mergeWithBase(repo *git.Repository, fp string, base string, head string, current []byte, content []byte) ([]byte, bool, error) {
+	if current == nil {
+		// file does not exist now, nothing to merge with
+		return content, true, nil
+	}
+	if base == head {
+		return content, true, nil
+	}
+	commit, err := getCommitOfVersion(repo, base)
+	if err != nil {
+		return nil, false, err
+	}
+	if commit == nil {
+		return nil, false, errors.New("version " + base + " not found")
+	}
+	var ancestor []byte
+	str, err := getCommitFile(repo, commit, fp)
+	commit.Free()
+	if err != nil {
+		return nil, false, err
+	}
+	if str != nil {
+		ancestor = []byte(*str)
+	}
+	if bytes.Equal(ancestor, current) {
+		// the file is not changed since base
+		return content, true, nil
+	}
+	if wikiConfig.verbose {
+		log.Printf("[ DEBUG ] %s changed since %s, try merge\n", fp, base)
+	}
+
+	result, err := git.MergeFile(
+		git.MergeFileInput{Path: fp, Mode: 0100644, Contents: ancestor},
+		git.MergeFileInput{Path: fp, Mode: 0100644, Contents: current},
+		git.MergeFileInput{Path: fp, Mode: 0100644, Contents: content},
+		&git.MergeFileOptions{AncestorLabel: base, OurLabel: "current", TheirLabel: "yours"},
+	)
+	if err != nil {
+		return nil, false, err
+	}
+	defer result.Free()
+
+	merged := make([]byte, len(result.Contents))
+	copy(merged, result.Contents)
+	return merged, result.Automergeable, nil
+}
+
+// the latest version for an edit of fp, the tip of the draft branch (or HEAD for a new one), or HEAD,
+// and the content of fp there, nil if it does not exist; without a branch it is read from the working tree
+func (this *Wiki) currentVersion(repo *git.Repository, branch string, fp string) (head string, current []byte, err error) {
+	var ref *git.Reference
+	if len(branch) > 0 {
+		ref, _ = repo.References.Lookup("refs/heads/" + branch)
+	}
+	if ref == nil {
+		// fails if nothing is committed yet
+		ref, _ = repo.Head()
+	}
+	if ref != nil {
+		defer ref.Free()
+		head = ref.Target().String()
+	}
+	if len(branch) == 0 || len(head) == 0 {
+		current, _ = ioutil.ReadFile(this.file(fp))
+		if len(branch) > 0 {
+			// a draft branch of an empty repository starts empty
+			current = nil
+		}
+		return head, current, nil
+	}
+	commit, err := repo.LookupCommit(ref.Target())
+	if err != nil {
+		return "", nil, err
+	}
+	defer commit.Free()
+	str, err := getCommitFile(repo, commit, fp)
+	if err != nil {
+		return "", nil, err
+	}
+	if str != nil {
+		current = []byte(*str)
+	}
+	return head, current, nil
+}
+
+// save content edited from the base version as fp, on the draft branch if given
+// the check against the latest version, the merge and the commit all run in one write job, so no edit is lost
+// nothing is committed if the changes since base conflict, the content with conflict markers is returned instead,
+// together with the version it is based on
+func (this *Wiki) mergeAndCommit(branch string, fp string, base string, content []byte, message string, minor bool, author string, author_gmail string) (merged []byte, head string, clean bool, err error) {
+	err = this.repo.Write(func(repo *git.Repository, index *git.Index) error {
+		var current []byte
+		var err error
+		head, current, err = this.currentVersion(repo, branch, fp)
+		if err != nil {
+			return err
+		}
+		merged, clean = content, true
+		if len(base) > 0 {
+			merged, clean, err = mergeWithBase(repo, fp, base, head, current, content)
+			if err != nil || !clean {
+				return err
+			}
+		}
+
+		comment := message
+		if len(comment) == 0 && current != nil {
+			comment = "update " + fp
+		} else if len(comment) == 0 {
+			comment = "upload to " + fp
+		}
+		comment = buildCommitMessage(comment, minor)
+		if len(branch) > 0 {
+			return this.commitToBranch(repo, branch, fp, merged, comment, author, author_gmail)
+		}
+		return this.saveFile(repo, index, fp, merged, comment, author, author_gmail, time.Now())
+	})
+	return merged, head, clean, err
+}
+
+//save md file and git commit, for .md
+func (this *Wiki) saveAndCommit(fp string, content []byte, comment string, author string, author_gmail string) error {
+	return this.saveAndCommitAt(fp, content, comment, author, author_gmail, time.Now())
+}
+
+// save and commit with the given author time, e.g. for revisions of an import
+func (this *Wiki) saveAndCommitAt(fp string, content []byte, comment string, author string, author_gmail string, when time.Time) error {
+	return this.repo.Write(func(repo *git.Repository, index *git.Index) error {
+		return this.saveFile(repo, index, fp, content, comment, author, author_gmail, when)
+	})
+}
+
+// save several files in one commit, e.g. a page together with its option/head/tail files
+func (this *Wiki) saveFilesAndCommit(fps []string, contents [][]byte, comment string, author string, author_gmail string) error {
+	return this.repo.Write(func(repo *git.Repository, index *git.Index) error {
+		for i, fp := range fps {
+			if err := this.stageFile(index, fp, contents[i]); err != nil {
+				return err
+			}
+		}
+		return this.commitIndex(repo, index, comment, author, author_gmail)
+	})
+}
+
+// write fp to the working tree and commit it on top of HEAD, in a write job
+func (this *Wiki) saveFile(repo *git.Repository, index *git.Index, fp string, content []byte, comment string, author string, author_gmail string, when time.Time) error {
+	if err := this.stageFile(index, fp, content); err != nil {
+		return err
+	}
+	return this.commitIndexAt(repo, index, comment, author, author_gmail, when)
+}
+
+// write fp to the working tree and add it to the index, in a write job
+func (this *Wiki) stageFile(index *git.Index, fp string, content []byte) error {
+	err := os.MkdirAll(filepath.Dir(this.file(fp)), 0700)
+	if err != nil {
+		return err
+	}
+
+	err = this.repo.WriteFile(this.file(fp), content, 0600)
+	if err != nil {
+		return err
+	}
+
+	return index.AddByPath(fp)
+}
+
+// commit content as fp on top of a draft branch, the working tree and index are left untouched
+func (this *Wiki) saveAndCommitToBranch(branch string, fp string, content []byte, comment string, author string, author_gmail string) error {
+	return this.repo.Write(func(repo *git.Repository, _ *git.Index) error {
+		return this.commitToBranch(repo, branch, fp, content, comment, author, author_gmail)
+	})
+}
+
+// commit fp on the draft branch without touching the working tree, in a write job
+func (this *Wiki) commitToBranch(repo *git.Repository, branch string, fp string, content []byte, comment string, author string, author_gmail string) error {
+	refname := "refs/heads/" + branch
+	ref, err := repo.References.Lookup(refname)
+	if err != nil {
+		// a new draft branch starts from HEAD
+		ref, err = repo.Head()
+	}
+	var parent *git.Commit
+	if err == nil {
+		parent, err = repo.LookupCommit(ref.Target())
+		ref.Free()
+		if err != nil {
+			return err
+		}
+		defer parent.Free()
+	}
+
+	// build the tree in memory, based on the tree of parent
+	index, err := git.NewIndex()
+	if err != nil {
+		return err
+	}
+	defer index.Free()
+
+	if parent != nil {
+		tree, err := parent.Tree()
+		if err != nil {
+			return err
+		}
+		err = index.ReadTree(tree)
+		tree.Free()
+		if err != nil {
+			return err
+		}
+	}
+
+	blobId, err := repo.CreateBlobFromBuffer(content)
+	if err != nil {
+		return err
+	}
+	err = index.Add(&git.IndexEntry{Path: fp, Mode: git.FilemodeBlob, Id: blobId, Size: uint32(len(content))})
+	if err != nil {
+		return err
+	}
+
+	treeId, err := index.WriteTreeTo(repo)
+	if err != nil {
+		return err
+	}
+	tree, err := repo.LookupTree(treeId)
+	if err != nil {
+		return err
+	}
+	defer tree.Free()
+
+	sig := &git.Signature{
+		Name:  author,
+		Email: author_gmail,
+		When:  time.Now(),
+	}
+	if parent != nil {
+		_, err = repo.CreateCommit(refname, sig, sig, comment, tree, parent)
+	} else {
+		_, err = repo.CreateCommit(refname, sig, sig, comment, tree)
+	}
+	return err
+}
+
+// remove files and git commit, for .md and its option/head/tail files
+func (this *Wiki) removeAndCommit(fps []string, comment string, author string, author_gmail string) error {
+	return this.removeAndCommitAt(fps, comment, author, author_gmail, time.Now())
+}
+
+func (this *Wiki) removeAndCommitAt(fps []string, comment string, author string, author_gmail string, when time.Time) error {
+	return this.repo.Write(func(repo *git.Repository, index *git.Index) error {
+		var err error
+
+		tracked := false
+		for _, fp := range fps {
+			if _, err = index.Find(fp); err != nil {
+				// not in git, just deleted from the filesystem
+				continue
+			}
+			err = index.RemoveByPath(fp)
+			if err != nil {
+				return err
+			}
+			tracked = true
+		}
+
+		if tracked {
+			err = this.commitIndexAt(repo, index, comment, author, author_gmail, when)
+			if err != nil {
+				return err
+			}
+		}
+
+		// the files are unlinked only once the removal is committed
+		for _, fp := range fps {
+			err = os.Remove(this.file(fp))
+			if err != nil && !os.IsNotExist(err) {
+				if !tracked {
+					return err
+				}
+				log.Printf("[ WARN ] %s is removed from git but not from the working tree: %v", fp, err)
+			}
+		}
+		return nil
+	})
+}
+
+// rename files and git commit, an optional stub file is written and committed together
+// nothing is renamed if any of the targets exists
+func (this *Wiki) moveAndCommit(from []string, to []string, stub string, stub_content []byte, comment string, author string, author_gmail string) error {
+	return this.repo.Write(func(repo *git.Repository, index *git.Index) error {
+		var err error
+
+		for _, fp := range to {
+			if _, err = os.Stat(this.file(fp)); err == nil {
+				return &os.PathError{Op: "move", Path: fp, Err: os.ErrExist}
+			}
+		}
+		for i, fp := range from {
+			if _, err = os.Stat(this.file(fp)); os.IsNotExist(err) {
+				// e.g. the page has no .head/.tail
+				continue
+			}
+			err = os.MkdirAll(filepath.Dir(this.file(to[i])), 0700)
+			if err != nil {
+				return err
+			}
+			err = this.repo.Rename(this.file(fp), this.file(to[i]))
+			if err != nil {
+				return err
+			}
+			if _, err = index.Find(fp); err == nil {
+				err = index.RemoveByPath(fp)
+				if err != nil {
+					return err
+				}
+			}
+			err = index.AddByPath(to[i])
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(stub) > 0 {
+			err = this.repo.WriteFile(this.file(stub), stub_content, 0600)
+			if err != nil {
+				return err
+			}
+			err = index.AddByPath(stub)
+			if err != nil {
+				return err
+			}
+		}
+
+		return this.commitIndex(repo, index, comment, author, author_gmail)
+	})
+}
+
+// write the index as a tree and commit it on top of HEAD, the index file is written by the write queue
+func (this *Wiki) commitIndex(repo *git.Repository, index *git.Index, comment string, author string, author_gmail string) error {
+	return this.commitIndexAt(repo, index, comment, author, author_gmail, time.Now())
+}
+
+func (this *Wiki) commitIndexAt(repo *git.Repository, index *git.Index, comment string, author string, author_gmail string, when time.Time) error {
+	treeId, err := index.WriteTree()
+	if err != nil {
+		return err
+	}
+
+	tree, err := repo.LookupTree(treeId)
+	if err != nil {
+		return err
+	}
+
+	sig := &git.Signature{
+		Name:  author,
+		Email: author_gmail,
+		When:  when,
+	}
+
+	currentBranch, err := repo.Head()
+	if err == nil && currentBranch != nil {
+		currentTip, err2 := repo.LookupCommit(currentBranch.Target())
+		if err2 != nil {
+			return err2
+		}
+		_, err = repo.CreateCommit("HEAD", sig, sig, comment, tree, currentTip)
+	} else {
+		_, err = repo.CreateCommit("HEAD", sig, sig, comment, tree)
+	}
+
+	if err != nil {
+		return err
+	}
+	this.requestPush()
+	return nil
+}
+func (this *Wiki) getFileOfVersion(fileName string, version string) ([]byte, error) {
+	var err error
+
+	repo, err := this.repo.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer this.repo.Release(repo)
+
+	commit, err := getCommitOfVersion(repo, version)
+	if err != nil || commit == nil {
+		return nil, err
+	}
+	defer commit.Free()
+
+	str, err := getCommitFile(repo, commit, fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var s []byte
+	if str != nil {
+		s = []byte(*str)
+	}
+	return s, nil
+}
+
+// find the commit of version in git revision syntax, nil if no commit matches
+// e.g. full or short sha, tag, branch, HEAD~3, master@{2024-01-01}
+func getCommitOfVersion(repo *git.Repository, version string) (*git.Commit, error) {
+	if m := versionDateRe.FindStringSubmatch(version); m != nil {
+		if when, err := parseVersionDate(m[2]); err == nil {
+			return getCommitAsOf(repo, m[1], when)
+		}
+		// not a date we know, e.g. @{1} or @{yesterday}, leave it to the reflog
+	}
+
+	obj, err := repo.RevparseSingle(version)
+	if err != nil {
+		if git.IsErrorCode(err, git.ErrAmbiguous) {
+			return nil, errors.New("version " + version + " is ambiguous, please use a longer one")
+		}
+		// malformed or not found, nothing matches anyway
+		return nil, nil
+	}
+	defer obj.Free()
+
+	// tags point to commits
+	peeled, err := obj.Peel(git.ObjectCommit)
+	if err != nil {
+		return nil, nil
+	}
+	defer peeled.Free()
+	return peeled.AsCommit()
+}
+
+var versionDateRe = regexp.MustCompile(`^(.*)@\{([^{}]+)\}$`)
+
+// dates accepted in @{...}, a date alone means the end of that day
+func parseVersionDate(s string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t.Add(24*time.Hour - time.Second), nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05", time.RFC3339} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("unknown date " + s)
+}
+
+// like parseVersionDate, but a date alone means the start of that day
+func parseSinceDate(s string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	return parseVersionDate(s)
+}
+
+// the wiki as of a date, i.e. the last commit on the first-parent line of rev committed no later than when
+func getCommitAsOf(repo *git.Repository, rev string, when time.Time) (*git.Commit, error) {
+	if len(rev) == 0 {
+		rev = "HEAD"
+	}
+	commit, err := getCommitOfVersion(repo, rev)
+	if err != nil || commit == nil {
+		return nil, err
+	}
+	for commit != nil && commit.Committer().When.After(when) {
+		parent := commit.Parent(0)
+		commit.Free()
+		commit = parent
+	}
+	return commit, nil
+}
+
+// resolve version to the full sha of a commit, empty if no commit matches
+func (this *Wiki) resolveVersion(version string) (string, error) {
+	repo, err := this.repo.Open()
+	if err != nil {
+		return "", err
+	}
+	defer this.repo.Release(repo)
+
+	commit, err := getCommitOfVersion(repo, version)
+	if err != nil || commit == nil {
+		return "", err
+	}
+	defer commit.Free()
+	return commit.Id().String(), nil
+}
+
+// private implementation, starts with lower case
+func (this *Wiki) getFileDiff(fileName string, diff_versions []string) (*string, error) {
+	// only diff .md file
+	// diff folder is not supported  or TODO?
+	var err error
+
 	// open repo
-	repo, err := git.OpenRepository(".")
+	repo, err := this.repo.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer this.repo.Release(repo)
+
+	// get file of diff_versions[0]
+	obj0, err := repo.RevparseSingle(fmt.Sprintf("%s:%s", diff_versions[0], fileName))
+	if err != nil || obj0 == nil {
+		return nil, err
+	}
+	// get file of diff_versions[1]
+	obj1, err := repo.RevparseSingle(fmt.Sprintf("%s:%s", diff_versions[1], fileName))
+	if err != nil || obj1 == nil {
+		return nil, err
+	}
+
+	// get blobs for `git diff`
+	blob0, err := obj0.AsBlob()
+	if err != nil {
+		return nil, err
+	}
+
+	blob1, err := obj1.AsBlob()
+	if err != nil {
+		return nil, err
+	}
+
+	diffResult := ""
+	filecb := func(diffDelta git.DiffDelta, progress float64) (git.DiffForEachHunkCallback, error) {
+		// diffResult += fmt.Sprintf("delta old file: %s new file %s\n",diffDelta.OldFile.Path,diffDelta.NewFile.Path)
+		hunkcb := func(diffHunk git.DiffHunk) (git.DiffForEachLineCallback, error) {
+			diffResult += fmt.Sprintf("%s", diffHunk.Header)
+			linecb := func(diffLine git.DiffLine) error {
+				diffPrefix := " "
+				switch diffLine.Origin {
+				case git.DiffLineAddition:
+					diffPrefix = "+"
+				case git.DiffLineDeletion:
+					diffPrefix = "-"
+				}
+				diffResult += fmt.Sprintf("%s%s", diffPrefix, diffLine.Content)
+				return nil
+			}
+			return linecb, nil
+		}
+		return hunkcb, nil
+	}
+
+	// diff two blobs
+	err = git.DiffBlobs(
+		blob0,
+		"",
+		blob1,
+		"",
+		nil,
+		filecb,
+		git.DiffDetailLines,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &diffResult, nil
+}
+func getCommitFile(repo *git.Repository, commit *git.Commit, fileName string) (*string, error) {
+	var err error
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	defer tree.Free()
+
+	entry, err := getTreeEntry(tree, fileName)
+	if entry == nil || err != nil {
+		return nil, err
+	}
+
+	oid := entry.Id
+	blb, err := repo.LookupBlob(oid)
+	if err != nil {
+		return nil, err
+	}
+	defer blb.Free()
+
+	ret := string(blb.Contents())
+	return &ret, nil
+}
+
+func getTreeEntry(tree *git.Tree, fp string) (*git.TreeEntry, error) {
+	if strings.IndexByte(fp, '/') >= 0 {
+		return tree.EntryByPath(fp)
+	}
+	return tree.EntryByName(fp), nil
+}
+
+// if fp is added by a rename in the commit, return the name before renaming
+func getRenameSource(repo *git.Repository, commit *git.Commit, tree *git.Tree, fp string) string {
+	parent := commit.Parent(0)
+	if parent == nil {
+		return ""
+	}
+	defer parent.Free()
+
+	parentTree, err := parent.Tree()
+	if err != nil {
+		return ""
+	}
+	defer parentTree.Free()
+
+	if entry, _ := getTreeEntry(parentTree, fp); entry != nil {
+		// fp exists before this commit, not renamed
+		return ""
+	}
+
+	diff, err := repo.DiffTreeToTree(parentTree, tree, nil)
+	if err != nil {
+		return ""
+	}
+	defer diff.Free()
+
+	opts, err := git.DefaultDiffFindOptions()
+	if err != nil {
+		return ""
+	}
+	opts.Flags = git.DiffFindRenames
+	err = diff.FindSimilar(&opts)
+	if err != nil {
+		return ""
+	}
+
+	n, err := diff.NumDeltas()
+	if err != nil {
+		return ""
+	}
+	for i := 0; i < n; i++ {
+		delta, err := diff.Delta(i)
+		if err != nil {
+			return ""
+		}
+		if delta.Status == git.DeltaRenamed && delta.NewFile.Path == fp {
+			return delta.OldFile.Path
+		}
+	}
+	return ""
+}
+
+func buildCommitEntry(commit *git.Commit, entry *git.TreeEntry) CommitEntry {
+	commitEntry := newCommitEntry(commit)
+	commitEntry.EntryId = entry.Id.String()
+	return commitEntry
+}
+
+func newCommitEntry(commit *git.Commit) CommitEntry {
+	message, minor := parseCommitMessage(commit.Message())
+	return CommitEntry{
+		Id:        commit.Id().String(),
+		Message:   message,
+		Minor:     minor,
+		Author:    commit.Author().Name,
+		Timestamp: commit.Author().When,
+	}
+}
+
+// the commit message of a save, with the trailer of minor edits
+func buildCommitMessage(message string, minor bool) string {
+	if minor {
+		return message + "\n\n" + MINOR_TRAILER
+	}
+	return message
+}
+
+// the message without the minor edit trailer, and whether it was there
+func parseCommitMessage(message string) (string, bool) {
+	lines := strings.Split(strings.TrimRight(message, "\n"), "\n")
+	last := strings.TrimSpace(lines[len(lines)-1])
+	if len(lines) < 2 || !strings.EqualFold(last, MINOR_TRAILER) {
+		return message, false
+	}
+	return strings.TrimRight(strings.Join(lines[:len(lines)-1], "\n"), "\n") + "\n", true
+}
+
+// filters of getHistory, the zero value lists everything from HEAD
+type historyFilter struct {
+	After     string // the cursor of paging, only versions older than this commit
+	Since     time.Time
+	Until     time.Time
+	Author    string // part of the author name or email
+	HideMinor bool   // the latest version is always listed
+}
+
+func (this *historyFilter) match(entry CommitEntry, email string, latest bool) bool {
+	if !this.Until.IsZero() && entry.Timestamp.After(this.Until) {
+		return false
+	}
+	if this.HideMinor && entry.Minor && !latest {
+		return false
+	}
+	author := strings.ToLower(this.Author)
+	if len(author) > 0 && !strings.Contains(strings.ToLower(entry.Author), author) &&
+		!strings.Contains(strings.ToLower(email), author) {
+		return false
+	}
+	return true
+}
+
+// versions of a file fed from the latest to the oldest, filtered and paged
+type historyCollector struct {
+	filter  historyFilter
+	size    int
+	entries []CommitEntry
+	more    bool // there are older versions for the next page
+	passed  bool // the cursor has been passed
+	latest  bool // the next version is the latest one
+}
+
+func newHistoryCollector(size int, filter historyFilter) *historyCollector {
+	passed := len(filter.After) == 0
+	return &historyCollector{filter: filter, size: size, passed: passed, latest: passed}
+}
+
+// whether the version of commit id is before the cursor and should be skipped
+func (this *historyCollector) skip(id string) bool {
+	if this.passed {
+		return false
+	}
+	this.passed = id == this.filter.After
+	return true
+}
+
+// take the next older version, false when no more versions are needed
+func (this *historyCollector) add(entry CommitEntry, email string) bool {
+	if this.skip(entry.Id) {
+		return true
+	}
+	if !this.filter.Since.IsZero() && entry.Timestamp.Before(this.filter.Since) {
+		return false
+	}
+	if this.filter.match(entry, email, this.latest) {
+		if this.size > 0 && len(this.entries) >= this.size {
+			this.more = true
+			return false
+		}
+		this.entries = append(this.entries, entry)
+	}
+	this.latest = false
+	return true
+}
+
+// history of fp, from the tip of branch, or HEAD if branch is empty
+// up to size versions matching filter, more is set if there are older ones left for the next page
+// the history of HEAD comes from the path index, draft branches are walked commit by commit
+func (this *Wiki) getHistory(fp string, size int, branch string, filter historyFilter) (filehistory []CommitEntry, more bool, err error) {
+	if len(fp) == 0 {
+		return nil, false, nil
+	}
+	repo, err := this.repo.Open()
+	if err != nil {
+		return nil, false, err
+	}
+	defer this.repo.Release(repo)
+
+	collector := newHistoryCollector(size, filter)
+	if len(branch) > 0 || !this.repo.index.History(repo, fp, collector) {
+		collector = newHistoryCollector(size, filter)
+		if err = walkHistory(repo, fp, branch, collector); err != nil {
+			return nil, false, err
+		}
+	}
+	if !collector.passed {
+		return nil, false, errors.New("version " + filter.After + " not found in the history of " + fp)
+	}
+	return collector.entries, collector.more, nil
+}
+
+// feed the versions of fp to collector by walking every commit from the tip of branch
+func walkHistory(repo *git.Repository, fp string, branch string, collector *historyCollector) error {
+	revwalk, err := repo.Walk()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer repo.Free()
+	defer revwalk.Free()
 
-	// get file of diff_versions[0]
-	obj0, err := repo.RevparseSingle(fmt.Sprintf("%s:%s", diff_versions[0], fileName))
-	if err != nil || obj0 == nil {
-		return nil, err
+	if start := historyCursor(repo, fp, collector.filter.After); start != nil {
+		// no need to walk the newer commits again
+		err = revwalk.Push(start)
+	} else if len(branch) > 0 {
+		err = revwalk.PushRef("refs/heads/" + branch)
+		if err != nil {
+			// the draft branch is not created yet
+			err = revwalk.PushHead()
+		}
+	} else {
+		err = revwalk.PushHead()
 	}
-	// get file of diff_versions[1]
-	obj1, err := repo.RevparseSingle(fmt.Sprintf("%s:%s", diff_versions[1], fileName))
-	if err != nil || obj1 == nil {
-		return nil, err
+	if err != nil {
+		return err
 	}
 
-	// get blobs for `git diff`
-	blob0, err := obj0.AsBlob()
+	// walk commits descending by time
+	revwalk.Sorting(git.SortTime)
+
+	// the file name in the commit being walked, changes when a rename is found
+	curfp := fp
+	renamed := false
+	// the entry is not done until an older commit changes the file
+	var pending *CommitEntry
+	var pendingEmail string
+	stopped := false
+	// the error stopping the walk from inside the callback
+	var walkErr error
+
+	err = revwalk.Iterate(func(commit *git.Commit) bool {
+		defer commit.Free()
+
+		tree, err := commit.Tree()
+		if err != nil {
+			walkErr = err
+			return false
+		}
+		defer tree.Free()
+
+		entry, err := getTreeEntry(tree, curfp)
+
+		if entry != nil && err == nil {
+			commitEntry := buildCommitEntry(commit, entry)
+			if curfp != fp {
+				commitEntry.OldPath = curfp
+			}
+			if pending != nil && (renamed || pending.EntryId != entry.Id.String()) {
+				// earlier commit points to the new file entry
+				// it means that the pending one has changed the file (or renamed it)
+				if !collector.add(*pending, pendingEmail) {
+					stopped = true
+					return false
+				}
+			}
+			// earlier commit points to the same file entry
+			// it means that the later one didn't change the file, so replace it
+			pending, pendingEmail = &commitEntry, commit.Author().Email
+
+			// follow the file if it was renamed in this commit
+			renamed = false
+			if oldfp := getRenameSource(repo, commit, tree, curfp); len(oldfp) > 0 {
+				curfp = oldfp
+				renamed = true
+			}
+		}
+		return true
+	})
+	if err == nil {
+		err = walkErr
+	}
+	if err != nil {
+		return err
+	}
+	if pending != nil && !stopped {
+		collector.add(*pending, pendingEmail)
+	}
+	return nil
+}
+
+// the commit to start the history after, nil if fp had another name then, i.e. the walk should follow renames from the tip
+func historyCursor(repo *git.Repository, fp string, after string) *git.Oid {
+	if len(after) == 0 {
+		return nil
+	}
+	oid, err := git.NewOid(after)
+	if err != nil {
+		return nil
+	}
+	commit, err := repo.LookupCommit(oid)
+	if err != nil {
+		return nil
+	}
+	defer commit.Free()
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil
+	}
+	defer tree.Free()
+	if entry, err := getTreeEntry(tree, fp); err != nil || entry == nil {
+		return nil
+	}
+	return oid
+}
+
+// local branches except the current one, with files changed since they forked
+func (this *Wiki) getBranches() ([]BranchEntry, error) {
+	repo, err := this.repo.Open()
 	if err != nil {
 		return nil, err
 	}
+	defer this.repo.Release(repo)
 
-	blob1, err := obj1.AsBlob()
+	current, _ := headBranch(repo)
+	var ours *git.Oid
+	if head, err := repo.Head(); err == nil {
+		ours = head.Target()
+		head.Free()
+	}
+
+	iter, err := repo.NewBranchIterator(git.BranchLocal)
 	if err != nil {
 		return nil, err
 	}
+	defer iter.Free()
 
-	diffResult := ""
-	filecb := func(diffDelta git.DiffDelta, progress float64) (git.DiffForEachHunkCallback, error) {
-		// diffResult += fmt.Sprintf("delta old file: %s new file %s\n",diffDelta.OldFile.Path,diffDelta.NewFile.Path)
-		hunkcb := func(diffHunk git.DiffHunk) (git.DiffForEachLineCallback, error) {
-			diffResult += fmt.Sprintf("%s", diffHunk.Header)
-			linecb := func(diffLine git.DiffLine) error {
-				diffPrefix := " "
-				switch diffLine.Origin {
-				case git.DiffLineAddition:
-					diffPrefix = "+"
-				case git.DiffLineDeletion:
-					diffPrefix = "-"
+	branches := []BranchEntry{}
+	err = iter.ForEach(func(branch *git.Branch, branchType git.BranchType) error {
+		defer branch.Free()
+		if branch.Reference.Name() == current {
+			return nil
+		}
+		name, err := branch.Name()
+		if err != nil {
+			return err
+		}
+		tip, err := repo.LookupCommit(branch.Target())
+		if err != nil {
+			return err
+		}
+		defer tip.Free()
+
+		tree, err := tip.Tree()
+		if err != nil {
+			return err
+		}
+		defer tree.Free()
+
+		var baseTree *git.Tree
+		if ours != nil {
+			if base, err := repo.MergeBase(ours, tip.Id()); err == nil {
+				if baseCommit, err := repo.LookupCommit(base); err == nil {
+					baseTree, _ = baseCommit.Tree()
+					baseCommit.Free()
 				}
-				diffResult += fmt.Sprintf("%s%s", diffPrefix, diffLine.Content)
-				return nil
 			}
-			return linecb, nil
 		}
-		return hunkcb, nil
+		if baseTree != nil {
+			defer baseTree.Free()
+		}
+
+		diff, err := repo.DiffTreeToTree(baseTree, tree, nil)
+		if err != nil {
+			return err
+		}
+		defer diff.Free()
+		n, err := diff.NumDeltas()
+		if err != nil {
+			return err
+		}
+		files := make([]string, 0, n)
+		for i := 0; i < n; i++ {
+			delta, err := diff.Delta(i)
+			if err != nil {
+				return err
+			}
+			files = append(files, delta.NewFile.Path)
+		}
+
+		branches = append(branches, BranchEntry{
+			Name:  name,
+			Tip:   newCommitEntry(tip),
+			Files: files,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	return branches, nil
+}
 
-	// diff two blobs
-	err = git.DiffBlobs(
-		blob0,
-		"",
-		blob1,
-		"",
-		nil,
-		filecb,
-		git.DiffDetailLines,
-	)
+// whether file is dir itself or under dir, dir is also the name of a page without .md
+func isUnderDir(file string, dir string) bool {
+	return len(dir) == 0 || file == dir || file == dir+".md" || strings.HasPrefix(file, dir+"/")
+}
+
+// the latest size commits changing files under dir, by author if it is not empty
+func (this *Wiki) getChanges(dir string, author string, size int, hideMinor bool) ([]ChangeEntry, error) {
+	repo, err := this.repo.Open()
 	if err != nil {
 		return nil, err
 	}
+	defer this.repo.Release(repo)
 
-	return &diffResult, nil
+	revwalk, err := repo.Walk()
+	if err != nil {
+		return nil, err
+	}
+	defer revwalk.Free()
+
+	changes := []ChangeEntry{}
+	err = revwalk.PushHead()
+	if err != nil {
+		// nothing committed yet
+		return changes, nil
+	}
+	// commits in the same second are still ordered by their parents
+	revwalk.Sorting(git.SortTopological | git.SortTime)
+
+	author = strings.ToLower(author)
+	var walkErr error
+	err = revwalk.Iterate(func(commit *git.Commit) bool {
+		defer commit.Free()
+
+		if len(author) > 0 && !strings.Contains(strings.ToLower(commit.Author().Name), author) &&
+			!strings.Contains(strings.ToLower(commit.Author().Email), author) {
+			return true
+		}
+		if hideMinor {
+			if _, minor := parseCommitMessage(commit.Message()); minor {
+				return true
+			}
+		}
+
+		files, err := getChangedFiles(repo, commit)
+		if err != nil {
+			walkErr = err
+			return false
+		}
+		var matched []string
+		for _, file := range files {
+			if isUnderDir(file, dir) {
+				matched = append(matched, file)
+			}
+		}
+		if len(matched) == 0 {
+			return true
+		}
+
+		changes = append(changes, ChangeEntry{
+			CommitEntry: newCommitEntry(commit),
+			Files:       matched,
+		})
+		return size <= 0 || len(changes) < size
+	})
+	if walkErr != nil {
+		return nil, walkErr
+	}
+	return changes, err
 }
-func getCommitFile(repo *git.Repository, commit *git.Commit, fileName string) (*string, error) {
-	var err error
+
+// files changed by commit against its first parent
+func getChangedFiles(repo *git.Repository, commit *git.Commit) ([]string, error) {
 	tree, err := commit.Tree()
 	if err != nil {
 		return nil, err
 	}
 	defer tree.Free()
 
-	var entry *git.TreeEntry
-	if strings.IndexByte(fileName, '/') >= 0 {
-		entry, err = tree.EntryByPath(fileName)
-	} else {
-		entry = tree.EntryByName(fileName)
-		err = nil
+	var parentTree *git.Tree
+	if parent := commit.Parent(0); parent != nil {
+		parentTree, err = parent.Tree()
+		parent.Free()
+		if err != nil {
+			return nil, err
+		}
+		defer parentTree.Free()
 	}
-	if entry == nil || err != nil {
+
+	diff, err := repo.DiffTreeToTree(parentTree, tree, nil)
+	if err != nil {
 		return nil, err
 	}
+	defer diff.Free()
 
-	oid := entry.Id
-	blb, err := repo.LookupBlob(oid)
+	n, err := diff.NumDeltas()
 	if err != nil {
 		return nil, err
 	}
-	defer blb.Free()
-
-	ret := string(blb.Contents())
-	return &ret, nil
+	files := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		delta, err := diff.Delta(i)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, delta.NewFile.Path)
+	}
+	return files, nil
 }
 
-func buildCommitEntry(commit *git.Commit, entry *git.TreeEntry) CommitEntry {
-	return CommitEntry{
-		Id:        commit.Id().String(),
-		EntryId:   entry.Id.String(),
-		Message:   commit.Message(),
-		Author:    commit.Author().Name,
-		Timestamp: commit.Author().When,
+// .md files under dir deleted by some commit and missing at HEAD, the latest deletion first
+// moved pages are left out, they still have a redirect stub
+func (this *Wiki) getDeletedPages(dir string) ([]DeletedEntry, error) {
+	repo, err := this.repo.Open()
+	if err != nil {
+		return nil, err
 	}
-}
+	defer this.repo.Release(repo)
 
-func getHistory(fp string, size int) ([]CommitEntry, error) {
-	if len(fp) == 0 {
-		return nil, nil
+	deleted := []DeletedEntry{}
+	head, err := repo.Head()
+	if err != nil {
+		// nothing committed yet
+		return deleted, nil
 	}
-	var err error
-	repo, err := git.OpenRepository(".")
+	headCommit, err := repo.LookupCommit(head.Target())
+	head.Free()
+	if err != nil {
+		return nil, err
+	}
+	defer headCommit.Free()
+	headTree, err := headCommit.Tree()
 	if err != nil {
 		return nil, err
 	}
-	defer repo.Free()
+	defer headTree.Free()
 
 	revwalk, err := repo.Walk()
 	if err != nil {
 		return nil, err
 	}
 	defer revwalk.Free()
-
-	err = revwalk.PushHead()
-	if err != nil {
+	if err = revwalk.PushHead(); err != nil {
 		return nil, err
 	}
+	revwalk.Sorting(git.SortTopological | git.SortTime)
 
-	// walk commits descending by time
-	revwalk.Sorting(git.SortTime)
-
-	var filehistory []CommitEntry
-	cnt := 0
-
+	seen := make(map[string]bool)
+	var walkErr error
 	err = revwalk.Iterate(func(commit *git.Commit) bool {
 		defer commit.Free()
+		parent := commit.Parent(0)
+		if parent == nil {
+			return true
+		}
+		defer parent.Free()
 
 		tree, err := commit.Tree()
 		if err != nil {
+			walkErr = err
 			return false
 		}
 		defer tree.Free()
-
-		var entry *git.TreeEntry
-		if strings.IndexByte(fp, '/') >= 0 {
-			entry, err = tree.EntryByPath(fp)
-		} else {
-			entry = tree.EntryByName(fp)
-			err = nil
+		parentTree, err := parent.Tree()
+		if err != nil {
+			walkErr = err
+			return false
+		}
+		defer parentTree.Free()
+		diff, err := repo.DiffTreeToTree(parentTree, tree, nil)
+		if err != nil {
+			walkErr = err
+			return false
 		}
+		defer diff.Free()
 
-		if entry != nil && err == nil {
-			filehistoryLen := len(filehistory)
-			if filehistoryLen == 0 {
-				// add entry to empty filehistory
-				filehistory = append(filehistory, buildCommitEntry(commit, entry))
-			} else {
-				if filehistory[filehistoryLen-1].EntryId == entry.Id.String() {
-					// earlier commit points to the same file entry
-					// it means that the later one didn't change the file, so replace it
-					filehistory = filehistory[:filehistoryLen-1]
-					filehistory = append(filehistory, buildCommitEntry(commit, entry))
-				} else {
-					// earlier commit points to the new file entry
-					// it means that the later one has changed the file
-					cnt += 1
-					if size > 0 && cnt >= size {
-						return false
-					}
-
-					// add the commit with new file entry
-					filehistory = append(filehistory, buildCommitEntry(commit, entry))
-				}
+		n, err := diff.NumDeltas()
+		if err != nil {
+			walkErr = err
+			return false
+		}
+		for i := 0; i < n; i++ {
+			delta, err := diff.Delta(i)
+			if err != nil {
+				walkErr = err
+				return false
+			}
+			fp := delta.OldFile.Path
+			if delta.Status != git.DeltaDeleted || !strings.HasSuffix(fp, ".md") || !isUnderDir(fp, dir) || seen[fp] {
+				continue
+			}
+			// only the latest deletion counts
+			seen[fp] = true
+			if entry, err := getTreeEntry(headTree, fp); err == nil && entry != nil {
+				continue
 			}
+			if _, err := os.Stat(this.file(fp)); err == nil || len(this.getRedirect(fp)) > 0 {
+				continue
+			}
+			deleted = append(deleted, DeletedEntry{
+				CommitEntry: newCommitEntry(commit),
+				Path:        fp,
+				LastVersion: parent.Id().String(),
+			})
 		}
 		return true
 	})
+	if walkErr != nil {
+		return nil, walkErr
+	}
+	return deleted, err
+}
+
+// all tags, the latest first, lightweight tags are listed with the commit info
+func (this *Wiki) getSnapshots() ([]TagEntry, error) {
+	repo, err := this.repo.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer this.repo.Release(repo)
+
+	snapshots := []TagEntry{}
+	err = repo.Tags.Foreach(func(name string, id *git.Oid) error {
+		snapshot := TagEntry{Name: strings.TrimPrefix(name, "refs/tags/")}
+		if tag, err := repo.LookupTag(id); err == nil {
+			snapshot.Id = tag.TargetId().String()
+			snapshot.Title = strings.TrimSpace(tag.Message())
+			if tagger := tag.Tagger(); tagger != nil {
+				snapshot.Tagger = tagger.Name
+				snapshot.Timestamp = tagger.When
+			}
+			tag.Free()
+		} else if commit, err := repo.LookupCommit(id); err == nil {
+			snapshot.Id = id.String()
+			snapshot.Title = strings.TrimSpace(commit.Message())
+			snapshot.Tagger = commit.Author().Name
+			snapshot.Timestamp = commit.Committer().When
+			commit.Free()
+		} else {
+			// tags of other objects are not snapshots
+			return nil
+		}
+		snapshots = append(snapshots, snapshot)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Timestamp.After(snapshots[j].Timestamp)
+	})
+	return snapshots, nil
+}
+
+// who last changed each line of the file at version, nil if the file does not exist
+func (this *Wiki) getBlame(fp string, version string) ([]BlameLine, error) {
+	if len(fp) == 0 || len(version) == 0 {
+		return nil, nil
+	}
+	repo, err := this.repo.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer this.repo.Release(repo)
+
+	commit, err := getCommitOfVersion(repo, version)
+	if err != nil || commit == nil {
+		return nil, err
+	}
+	defer commit.Free()
+
+	content, err := getCommitFile(repo, commit, fp)
+	if err != nil || content == nil {
+		return nil, err
+	}
+
+	opts, err := git.DefaultBlameOptions()
+	if err != nil {
+		return nil, err
+	}
+	opts.NewestCommit = commit.Id()
+	blame, err := repo.BlameFile(fp, &opts)
+	if err != nil {
+		return nil, err
+	}
+	defer blame.Free()
 
-	return filehistory, nil
+	if len(*content) == 0 {
+		return []BlameLine{}, nil
+	}
+	lines := strings.Split(strings.TrimSuffix(*content, "\n"), "\n")
+	blame_lines := make([]BlameLine, 0, len(lines))
+	messages := make(map[string]string)
+	for i, line := range lines {
+		hunk, err := blame.HunkByLine(i + 1)
+		if err != nil {
+			return nil, err
+		}
+		id := hunk.FinalCommitId.String()
+		message, ok := messages[id]
+		if !ok {
+			if c, err := repo.LookupCommit(hunk.FinalCommitId); err == nil {
+				message = c.Message()
+				c.Free()
+			}
+			messages[id] = message
+		}
+		blame_line := BlameLine{
+			CommitEntry: CommitEntry{
+				Id:      id,
+				Message: message,
+			},
+			Line:    i + 1,
+			Content: line,
+			First:   i+1 == int(hunk.FinalStartLineNumber),
+		}
+		if hunk.FinalSignature != nil {
+			blame_line.Author = hunk.FinalSignature.Name
+			blame_line.Timestamp = hunk.FinalSignature.When
+		}
+		blame_lines = append(blame_lines, blame_line)
+	}
+	return blame_lines, nil
 }
 
 func (this *RequestContext) Redirect(target string) error {
@@ -633,9 +2523,9 @@ func (this *RequestContext) Static(version string) error { // host static files
 	var err error
 
 	if len(version) > 0 {
-		content, err = getFileOfVersion(this.path, version)
+		content, err = this.wiki.getFileOfVersion(this.path, version)
 	} else {
-		content, err = ioutil.ReadFile(this.path)
+		content, err = ioutil.ReadFile(this.wiki.file(this.path))
 	}
 	if mimetype == "" {
 		if len(content) == 0 {
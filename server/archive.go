@@ -0,0 +1,331 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"github.com/libgit2/git2go"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// zip or tar(.gz) archives uploaded with ?upload=archive, every file goes into a single commit
+// and the other way around, ?archive=zip|tar.gz downloads a directory at any version
+
+const (
+	ARCHIVE_ZIP   = "zip"
+	ARCHIVE_TARGZ = "tar.gz"
+)
+
+// the multipart limit of uploads, also the limit of all extracted files
+const ARCHIVE_MAX_SIZE = 1048576 * 100
+
+type archiveEntry struct {
+	Path    string // relative to the wiki root
+	Content []byte
+}
+
+// extract the regular files of a zip, tar or tar.gz archive under dir, nothing is written yet
+// every path is checked the same way as the pages are served, any bad entry fails the whole archive
+func (this *Wiki) readArchive(data []byte, dir string) ([]archiveEntry, error) {
+	var entries []archiveEntry
+	var total int64
+	add := func(name string, r io.Reader) error {
+		fp, err := this.archivePath(dir, name)
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadAll(io.LimitReader(r, ARCHIVE_MAX_SIZE-total+1))
+		if err != nil {
+			return err
+		}
+		total += int64(len(content))
+		if total > ARCHIVE_MAX_SIZE {
+			return errors.New("archive is too large when extracted")
+		}
+		if strings.HasSuffix(fp, ".md") && bytes.Contains(content, []byte("</xmp>")) {
+			return errors.New(fp + " contains `</xmp>`, which will break strapdown system")
+		}
+		entries = append(entries, archiveEntry{Path: fp, Content: content})
+		return nil
+	}
+
+	if bytes.HasPrefix(data, []byte("PK\x03\x04")) || bytes.HasPrefix(data, []byte("PK\x05\x06")) {
+		reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range reader.File {
+			if file.FileInfo().IsDir() {
+				continue
+			}
+			if !file.Mode().IsRegular() {
+				return nil, errors.New(file.Name + " is not a regular file")
+			}
+			r, err := file.Open()
+			if err != nil {
+				return nil, err
+			}
+			err = add(file.Name, r)
+			r.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+	} else if err := readTar(data, add); err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, errors.New("no files found in the archive")
+	}
+	return entries, nil
+}
+
+func readTar(data []byte, add func(name string, r io.Reader) error) error {
+	var r io.Reader = bytes.NewReader(data)
+	if bytes.HasPrefix(data, []byte("\x1f\x8b")) {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	reader := tar.NewReader(r)
+	for {
+		hdr, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.New("not a zip, tar or tar.gz archive: " + err.Error())
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir, tar.TypeXGlobalHeader:
+			continue
+		case tar.TypeReg, tar.TypeRegA:
+			if err = add(hdr.Name, reader); err != nil {
+				return err
+			}
+		default:
+			return errors.New(hdr.Name + " is not a regular file")
+		}
+	}
+}
+
+// the path of an archive entry in the wiki, entries should never escape dir
+func (this *Wiki) archivePath(dir string, name string) (string, error) {
+	if strings.ContainsAny(name, "\x00\\") {
+		return "", errors.New("invalid character in file path " + name)
+	}
+	if strings.HasPrefix(name, "/") {
+		return "", errors.New("absolute file path " + name + " not allowed")
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", errors.New("file path " + name + " outside of the archive not allowed")
+		}
+	}
+	clean := path.Clean("/" + name)
+	if clean == "/" {
+		return "", errors.New("invalid file path " + name)
+	}
+	fp := strings.TrimPrefix(path.Join(dir, clean), "/")
+	for _, part := range strings.Split(fp, "/") {
+		if strings.ToLower(part) == ".git" {
+			return "", errors.New("access of .git related files/directory not allowed")
+		}
+	}
+	if reason := this.forbiddenPath(fp); len(reason) > 0 {
+		return "", errors.New(reason)
+	}
+	if isReservedPath(fp) {
+		return "", errors.New("cannot write to reserved path " + fp)
+	}
+	return fp, nil
+}
+
+// commit all entries on top of HEAD at once, then update the working tree to the new tree
+// the commit is taken back if the checkout would overwrite uncommitted changes
+func (this *Wiki) saveArchiveAndCommit(entries []archiveEntry, comment string, author string, author_gmail string) error {
+	return this.repo.Write(func(repo *git.Repository, _ *git.Index) error {
+		var parents []*git.Commit
+		if head, err := repo.Head(); err == nil {
+			parent, err := repo.LookupCommit(head.Target())
+			head.Free()
+			if err != nil {
+				return err
+			}
+			defer parent.Free()
+			parents = append(parents, parent)
+		}
+
+		index, err := git.NewIndex()
+		if err != nil {
+			return err
+		}
+		defer index.Free()
+
+		// the tree the working tree is checked out from, empty if nothing is committed yet
+		var baseline *git.Tree
+		if len(parents) > 0 {
+			baseline, err = parents[0].Tree()
+		} else {
+			var emptyId *git.Oid
+			if emptyId, err = index.WriteTreeTo(repo); err == nil {
+				baseline, err = repo.LookupTree(emptyId)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		defer baseline.Free()
+		if err = index.ReadTree(baseline); err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			oid, err := repo.CreateBlobFromBuffer(entry.Content)
+			if err != nil {
+				return err
+			}
+			err = index.Add(&git.IndexEntry{Path: entry.Path, Mode: git.FilemodeBlob, Id: oid})
+			if err != nil {
+				return err
+			}
+		}
+		treeId, err := index.WriteTreeTo(repo)
+		if err != nil {
+			return err
+		}
+		tree, err := repo.LookupTree(treeId)
+		if err != nil {
+			return err
+		}
+		defer tree.Free()
+
+		sig := &git.Signature{
+			Name:  author,
+			Email: author_gmail,
+			When:  time.Now(),
+		}
+		if _, err = repo.CreateCommit("HEAD", sig, sig, comment, tree, parents...); err != nil {
+			return err
+		}
+
+		// safe checkout fails before writing anything if a file has uncommitted changes
+		err = repo.CheckoutTree(tree, &git.CheckoutOptions{Strategy: git.CheckoutSafe, Baseline: baseline})
+		if err != nil {
+			if rerr := uncommitHead(repo, parents); rerr != nil {
+				log.Printf("[ WARN ] cannot take back the commit of the archive: %v", rerr)
+			}
+			return err
+		}
+		this.requestPush()
+		return nil
+	})
+}
+
+// move the current branch back to parents, or remove it if there is no parent
+func uncommitHead(repo *git.Repository, parents []*git.Commit) error {
+	branch, err := headBranch(repo)
+	if err != nil {
+		return err
+	}
+	if len(parents) > 0 {
+		ref, err := repo.References.Create(branch, parents[0].Id(), true, "take back an archive upload")
+		if err != nil {
+			return err
+		}
+		ref.Free()
+		return nil
+	}
+	ref, err := repo.References.Lookup(branch)
+	if err != nil {
+		return err
+	}
+	defer ref.Free()
+	return ref.Delete()
+}
+
+// stream the files of tree as an archive, every path is prefixed with prefix
+// files which should never be served, e.g. the password file, are left out
+func (this *Wiki) writeTreeArchive(w io.Writer, format string, repo *git.Repository, tree *git.Tree, dir string, prefix string, mtime time.Time) error {
+	var zw *zip.Writer
+	var tw *tar.Writer
+	if format == ARCHIVE_ZIP {
+		zw = zip.NewWriter(w)
+	} else {
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		tw = tar.NewWriter(gz)
+	}
+
+	var walkErr error
+	err := tree.Walk(func(root string, entry *git.TreeEntry) int {
+		fp := strings.TrimPrefix(path.Join(dir, root, entry.Name), "/")
+		if entry.Type == git.ObjectTree {
+			if strings.ToLower(entry.Name) == ".git" {
+				return 1 // skip the subtree
+			}
+			return 0
+		}
+		if entry.Type != git.ObjectBlob || len(this.forbiddenPath(fp)) > 0 {
+			return 0
+		}
+		blob, err := repo.LookupBlob(entry.Id)
+		if err != nil {
+			walkErr = err
+			return -1
+		}
+		defer blob.Free()
+		content := blob.Contents()
+		name := prefix + root + entry.Name
+
+		var mode os.FileMode = 0644
+		if entry.Filemode == git.FilemodeBlobExecutable {
+			mode = 0755
+		}
+		if zw != nil {
+			if entry.Filemode == git.FilemodeLink {
+				return 0
+			}
+			hdr := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: mtime}
+			hdr.SetMode(mode)
+			var f io.Writer
+			if f, walkErr = zw.CreateHeader(hdr); walkErr == nil {
+				_, walkErr = f.Write(content)
+			}
+		} else {
+			hdr := &tar.Header{Name: name, Mode: int64(mode), Size: int64(len(content)), ModTime: mtime, Typeflag: tar.TypeReg}
+			if entry.Filemode == git.FilemodeLink {
+				hdr.Typeflag, hdr.Linkname, hdr.Size, hdr.Mode = tar.TypeSymlink, string(content), 0, 0777
+				content = nil
+			}
+			if walkErr = tw.WriteHeader(hdr); walkErr == nil {
+				_, walkErr = tw.Write(content)
+			}
+		}
+		if walkErr != nil {
+			return -1
+		}
+		return 0
+	})
+	if walkErr != nil {
+		return walkErr
+	}
+	if err != nil {
+		return err
+	}
+	if zw != nil {
+		return zw.Close()
+	}
+	return tw.Close()
+}
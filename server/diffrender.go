@@ -0,0 +1,508 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/libgit2/git2go"
+	"html"
+	"html/template"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// server side rendering of diffs, selected by ?diffmode=
+// line changes come from libgit2, changed lines are then diffed word by word
+
+const (
+	DIFF_MODE_UNIFIED  = "unified"
+	DIFF_MODE_SIDE     = "side-by-side"
+	DIFF_MODE_WORDS    = "words"
+	DIFF_MODE_RENDERED = "rendered" // markdown rendered by strapdown, with changed words marked
+)
+
+// larger changed blocks are not diffed word by word, the table of LCS is len(a)*len(b)
+const WORD_DIFF_LIMIT = 4000000
+
+type diffLine struct {
+	Origin  byte // ' ', '+' or '-'
+	OldNo   int
+	NewNo   int
+	Content string // without the trailing newline
+}
+
+type diffHunk struct {
+	Header string
+	Lines  []diffLine
+}
+
+// consecutive deleted and added lines, or a context line if both are empty
+type diffBlock struct {
+	Context *diffLine
+	Dels    []diffLine
+	Adds    []diffLine
+}
+
+type wordOp struct {
+	Origin byte // ' ', '+' or '-'
+	Text   string
+}
+
+func isDiffMode(mode string) bool {
+	return mode == DIFF_MODE_UNIFIED || mode == DIFF_MODE_SIDE || mode == DIFF_MODE_WORDS || mode == DIFF_MODE_RENDERED
+}
+
+// render the diff of fp between two commits in mode, a missing file is diffed as empty
+func (this *Wiki) renderDiff(fp string, commits []string, mode string) (template.HTML, error) {
+	if !isDiffMode(mode) {
+		return "", errors.New("unknown diffmode " + mode + ", should be one of " +
+			strings.Join([]string{DIFF_MODE_UNIFIED, DIFF_MODE_SIDE, DIFF_MODE_WORDS, DIFF_MODE_RENDERED}, ", "))
+	}
+	var context uint32 = 3
+	if mode == DIFF_MODE_RENDERED {
+		// the whole document is rendered
+		context = 1 << 30
+	}
+	hunks, err := this.getDiffHunks(fp, commits, context)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	switch mode {
+	case DIFF_MODE_UNIFIED:
+		renderUnified(&buf, hunks)
+	case DIFF_MODE_SIDE:
+		renderSideBySide(&buf, hunks)
+	case DIFF_MODE_WORDS:
+		renderWords(&buf, hunks)
+	case DIFF_MODE_RENDERED:
+		if len(hunks) == 0 {
+			// nothing changed, just the document
+			content, err := this.getFileOfVersion(fp, commits[1])
+			if err != nil {
+				return "", err
+			}
+			return template.HTML(content), nil
+		}
+		renderMarkdown(&buf, hunks)
+	}
+	return template.HTML(buf.String()), nil
+}
+
+func (this *Wiki) getDiffHunks(fp string, commits []string, context uint32) ([]diffHunk, error) {
+	repo, err := this.repo.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer this.repo.Release(repo)
+
+	blobs := make([]*git.Blob, len(commits))
+	for i, version := range commits {
+		commit, err := getCommitOfVersion(repo, version)
+		if err != nil || commit == nil {
+			if err == nil {
+				err = errors.New("version " + version + " not found")
+			}
+			return nil, err
+		}
+		tree, err := commit.Tree()
+		commit.Free()
+		if err != nil {
+			return nil, err
+		}
+		entry, _ := getTreeEntry(tree, fp)
+		if entry != nil {
+			blobs[i], err = repo.LookupBlob(entry.Id)
+		}
+		tree.Free()
+		if err != nil {
+			return nil, err
+		}
+		if blobs[i] != nil {
+			defer blobs[i].Free()
+		}
+	}
+
+	opts, err := git.DefaultDiffOptions()
+	if err != nil {
+		return nil, err
+	}
+	opts.ContextLines = context
+
+	var hunks []diffHunk
+	filecb := func(diffDelta git.DiffDelta, progress float64) (git.DiffForEachHunkCallback, error) {
+		return collectHunks(&hunks), nil
+	}
+
+	err = git.DiffBlobs(blobs[0], fp, blobs[1], fp, &opts, filecb, git.DiffDetailLines)
+	if err != nil {
+		return nil, err
+	}
+	return hunks, nil
+}
+
+// every file changed by the commit against its first parent, with unified diffs
+func (this *Wiki) getCommitDiff(version string) (*CommitEntry, []FileChange, error) {
+	repo, err := this.repo.Open()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer this.repo.Release(repo)
+
+	commit, err := getCommitOfVersion(repo, version)
+	if err != nil || commit == nil {
+		if err == nil {
+			err = errors.New("version " + version + " not found")
+		}
+		return nil, nil, err
+	}
+	defer commit.Free()
+	entry := new(CommitEntry)
+	*entry = newCommitEntry(commit)
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tree.Free()
+	var parentTree *git.Tree
+	if parent := commit.Parent(0); parent != nil {
+		parentTree, err = parent.Tree()
+		parent.Free()
+		if err != nil {
+			return nil, nil, err
+		}
+		defer parentTree.Free()
+	}
+
+	opts, err := git.DefaultDiffOptions()
+	if err != nil {
+		return nil, nil, err
+	}
+	diff, err := repo.DiffTreeToTree(parentTree, tree, &opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer diff.Free()
+	findOpts, err := git.DefaultDiffFindOptions()
+	if err != nil {
+		return nil, nil, err
+	}
+	findOpts.Flags = git.DiffFindRenames
+	if err = diff.FindSimilar(&findOpts); err != nil {
+		return nil, nil, err
+	}
+
+	type fileHunks struct {
+		delta git.DiffDelta
+		hunks []diffHunk
+	}
+	var files []*fileHunks
+	filecb := func(delta git.DiffDelta, progress float64) (git.DiffForEachHunkCallback, error) {
+		file := &fileHunks{delta: delta}
+		files = append(files, file)
+		return collectHunks(&file.hunks), nil
+	}
+	if err = diff.ForEach(filecb, git.DiffDetailLines); err != nil {
+		return nil, nil, err
+	}
+
+	changes := make([]FileChange, 0, len(files))
+	for _, file := range files {
+		change := FileChange{
+			Commit: entry.Id,
+			Path:   file.delta.NewFile.Path,
+			Status: "modified",
+			Binary: file.delta.Flags&git.DiffFlagBinary != 0,
+		}
+		switch file.delta.Status {
+		case git.DeltaAdded:
+			change.Status = "added"
+		case git.DeltaDeleted:
+			change.Status = "deleted"
+			change.Path = file.delta.OldFile.Path
+		case git.DeltaRenamed:
+			change.Status = "renamed"
+			change.OldPath = file.delta.OldFile.Path
+		}
+		for _, hunk := range file.hunks {
+			for _, line := range hunk.Lines {
+				if line.Origin == '+' {
+					change.Added++
+				} else if line.Origin == '-' {
+					change.Removed++
+				}
+			}
+		}
+		if len(file.hunks) > 0 {
+			var buf bytes.Buffer
+			renderUnified(&buf, file.hunks)
+			change.Diff = template.HTML(buf.String())
+		}
+		changes = append(changes, change)
+	}
+	return entry, changes, nil
+}
+
+// append the hunks of a file and their lines to hunks
+func collectHunks(hunks *[]diffHunk) git.DiffForEachHunkCallback {
+	return func(h git.DiffHunk) (git.DiffForEachLineCallback, error) {
+		*hunks = append(*hunks, diffHunk{Header: strings.TrimSpace(h.Header)})
+		linecb := func(line git.DiffLine) error {
+			var origin byte
+			switch line.Origin {
+			case git.DiffLineContext:
+				origin = ' '
+			case git.DiffLineAddition:
+				origin = '+'
+			case git.DiffLineDeletion:
+				origin = '-'
+			default:
+				// e.g. no newline at end of file
+				return nil
+			}
+			hunk := &(*hunks)[len(*hunks)-1]
+			hunk.Lines = append(hunk.Lines, diffLine{
+				Origin:  origin,
+				OldNo:   line.OldLineno,
+				NewNo:   line.NewLineno,
+				Content: strings.TrimSuffix(line.Content, "\n"),
+			})
+			return nil
+		}
+		return linecb, nil
+	}
+}
+
+// group lines of a hunk into context lines and changed blocks
+func (this *diffHunk) blocks() []diffBlock {
+	var blocks []diffBlock
+	for i := 0; i < len(this.Lines); i++ {
+		line := &this.Lines[i]
+		if line.Origin == ' ' {
+			blocks = append(blocks, diffBlock{Context: line})
+			continue
+		}
+		block := diffBlock{}
+		for ; i < len(this.Lines) && this.Lines[i].Origin == '-'; i++ {
+			block.Dels = append(block.Dels, this.Lines[i])
+		}
+		for ; i < len(this.Lines) && this.Lines[i].Origin == '+'; i++ {
+			block.Adds = append(block.Adds, this.Lines[i])
+		}
+		i--
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+func joinLines(lines []diffLine) string {
+	contents := make([]string, len(lines))
+	for i, line := range lines {
+		contents[i] = line.Content
+	}
+	return strings.Join(contents, "\n")
+}
+
+// words, runs of spaces and single symbols, so CJK text is diffed char by char
+var wordRe = regexp.MustCompile(`\s+|\w+|.`)
+
+func splitWords(s string) []string {
+	return wordRe.FindAllString(s, -1)
+}
+
+// diff two texts word by word by the longest common subsequence
+func diffWords(a string, b string) []wordOp {
+	wa, wb := splitWords(a), splitWords(b)
+
+	// common prefix and suffix are kept out of the table
+	prefix := 0
+	for prefix < len(wa) && prefix < len(wb) && wa[prefix] == wb[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(wa)-prefix && suffix < len(wb)-prefix && wa[len(wa)-1-suffix] == wb[len(wb)-1-suffix] {
+		suffix++
+	}
+
+	var ops []wordOp
+	push := func(origin byte, text string) {
+		if len(text) == 0 {
+			return
+		}
+		if n := len(ops); n > 0 && ops[n-1].Origin == origin {
+			ops[n-1].Text += text
+			return
+		}
+		ops = append(ops, wordOp{Origin: origin, Text: text})
+	}
+
+	push(' ', strings.Join(wa[:prefix], ""))
+	ma, mb := wa[prefix:len(wa)-suffix], wb[prefix:len(wb)-suffix]
+	if len(ma)*len(mb) > WORD_DIFF_LIMIT {
+		push('-', strings.Join(ma, ""))
+		push('+', strings.Join(mb, ""))
+	} else {
+		// lcs[i][j] is the length of the LCS of ma[i:] and mb[j:]
+		width := len(mb) + 1
+		lcs := make([]int, (len(ma)+1)*width)
+		for i := len(ma) - 1; i >= 0; i-- {
+			for j := len(mb) - 1; j >= 0; j-- {
+				if ma[i] == mb[j] {
+					lcs[i*width+j] = lcs[(i+1)*width+j+1] + 1
+				} else if lcs[(i+1)*width+j] >= lcs[i*width+j+1] {
+					lcs[i*width+j] = lcs[(i+1)*width+j]
+				} else {
+					lcs[i*width+j] = lcs[i*width+j+1]
+				}
+			}
+		}
+		i, j := 0, 0
+		for i < len(ma) && j < len(mb) {
+			if ma[i] == mb[j] {
+				push(' ', ma[i])
+				i++
+				j++
+			} else if lcs[(i+1)*width+j] >= lcs[i*width+j+1] {
+				push('-', ma[i])
+				i++
+			} else {
+				push('+', mb[j])
+				j++
+			}
+		}
+		push('-', strings.Join(ma[i:], ""))
+		push('+', strings.Join(mb[j:], ""))
+	}
+	push(' ', strings.Join(wa[len(wa)-suffix:], ""))
+	return ops
+}
+
+// html of word ops, side is '-' or '+' for one side only, or ' ' for both
+func wordOpsHTML(ops []wordOp, side byte) string {
+	var buf bytes.Buffer
+	for _, op := range ops {
+		text := html.EscapeString(op.Text)
+		switch {
+		case op.Origin == ' ':
+			buf.WriteString(text)
+		case op.Origin == '-' && side != '+':
+			buf.WriteString("<del>" + text + "</del>")
+		case op.Origin == '+' && side != '-':
+			buf.WriteString("<ins>" + text + "</ins>")
+		}
+	}
+	return buf.String()
+}
+
+func lineNo(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	return strconv.Itoa(n)
+}
+
+func renderUnified(buf *bytes.Buffer, hunks []diffHunk) {
+	buf.WriteString(`<table class="diff diff-unified">`)
+	for _, hunk := range hunks {
+		buf.WriteString(`<tr class="diff-hunk"><td colspan="3">` + html.EscapeString(hunk.Header) + `</td></tr>`)
+		for _, line := range hunk.Lines {
+			class := "diff-context"
+			if line.Origin == '+' {
+				class = "diff-add"
+			} else if line.Origin == '-' {
+				class = "diff-del"
+			}
+			buf.WriteString(`<tr class="` + class + `"><td class="diff-num">` + lineNo(line.OldNo) + `</td><td class="diff-num">` + lineNo(line.NewNo) +
+				`</td><td class="diff-code">` + string(line.Origin) + html.EscapeString(line.Content) + `</td></tr>`)
+		}
+	}
+	buf.WriteString(`</table>`)
+}
+
+func renderSideBySide(buf *bytes.Buffer, hunks []diffHunk) {
+	buf.WriteString(`<table class="diff diff-side-by-side">`)
+	for _, hunk := range hunks {
+		buf.WriteString(`<tr class="diff-hunk"><td colspan="4">` + html.EscapeString(hunk.Header) + `</td></tr>`)
+		for _, block := range hunk.blocks() {
+			if block.Context != nil {
+				content := html.EscapeString(block.Context.Content)
+				buf.WriteString(`<tr class="diff-context"><td class="diff-num">` + lineNo(block.Context.OldNo) + `</td><td class="diff-code">` + content +
+					`</td><td class="diff-num">` + lineNo(block.Context.NewNo) + `</td><td class="diff-code">` + content + `</td></tr>`)
+				continue
+			}
+			// pair deleted and added lines row by row, paired lines are diffed word by word
+			for i := 0; i < len(block.Dels) || i < len(block.Adds); i++ {
+				var oldNo, newNo, oldHTML, newHTML string
+				oldClass, newClass := "diff-empty", "diff-empty"
+				if i < len(block.Dels) && i < len(block.Adds) {
+					ops := diffWords(block.Dels[i].Content, block.Adds[i].Content)
+					oldHTML, newHTML = wordOpsHTML(ops, '-'), wordOpsHTML(ops, '+')
+				} else if i < len(block.Dels) {
+					oldHTML = html.EscapeString(block.Dels[i].Content)
+				} else {
+					newHTML = html.EscapeString(block.Adds[i].Content)
+				}
+				if i < len(block.Dels) {
+					oldNo, oldClass = lineNo(block.Dels[i].OldNo), "diff-del"
+				}
+				if i < len(block.Adds) {
+					newNo, newClass = lineNo(block.Adds[i].NewNo), "diff-add"
+				}
+				buf.WriteString(`<tr><td class="diff-num">` + oldNo + `</td><td class="diff-code ` + oldClass + `">` + oldHTML +
+					`</td><td class="diff-num">` + newNo + `</td><td class="diff-code ` + newClass + `">` + newHTML + `</td></tr>`)
+			}
+		}
+	}
+	buf.WriteString(`</table>`)
+}
+
+// prose edits, the changed blocks are diffed word by word as a whole
+func renderWords(buf *bytes.Buffer, hunks []diffHunk) {
+	for _, hunk := range hunks {
+		buf.WriteString(`<div class="diff-hunk">` + html.EscapeString(hunk.Header) + `</div><pre class="diff diff-words">`)
+		for _, block := range hunk.blocks() {
+			if block.Context != nil {
+				buf.WriteString(html.EscapeString(block.Context.Content) + "\n")
+				continue
+			}
+			buf.WriteString(wordOpsHTML(diffWords(joinLines(block.Dels), joinLines(block.Adds)), ' ') + "\n")
+		}
+		buf.WriteString(`</pre>`)
+	}
+}
+
+// markdown of the new version, with deleted and inserted words wrapped in <del>/<ins>
+// the tags never span lines, so that the markdown structure is kept
+func renderMarkdown(buf *bytes.Buffer, hunks []diffHunk) {
+	for _, hunk := range hunks {
+		for _, block := range hunk.blocks() {
+			if block.Context != nil {
+				buf.WriteString(block.Context.Content + "\n")
+				continue
+			}
+			for _, op := range diffWords(joinLines(block.Dels), joinLines(block.Adds)) {
+				if op.Origin == ' ' {
+					buf.WriteString(op.Text)
+					continue
+				}
+				tag := "ins"
+				if op.Origin == '-' {
+					tag = "del"
+				}
+				for i, segment := range strings.Split(op.Text, "\n") {
+					if i > 0 {
+						buf.WriteString("\n")
+					}
+					if len(strings.TrimSpace(segment)) > 0 {
+						buf.WriteString("<" + tag + ">" + segment + "</" + tag + ">")
+					} else {
+						buf.WriteString(segment)
+					}
+				}
+			}
+			buf.WriteString("\n")
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/libgit2/git2go"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// -export writes the wiki at a version as a static site, e.g. for a read-only copy without the server
+// pages are rendered by the view template, links between pages are rewritten to the .html files,
+// and everything else in the tree is copied as it is
+
+var (
+	// [text](target "title")
+	exportInlineLinkRe = regexp.MustCompile(`(\]\(\s*<?)([^)\s>]+)`)
+	// [id]: target
+	exportRefLinkRe = regexp.MustCompile(`(?m)^(\s{0,3}\[[^\]]+\]:\s*<?)([^\s>]+)`)
+	// <a href="target">, <img src="target">
+	exportAttrLinkRe = regexp.MustCompile(`(\s(?:href|src)\s*=\s*["'])([^"']+)`)
+	// a link with a scheme, e.g. http: or mailto:
+	exportSchemeRe = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*:`)
+)
+
+func (this *Wiki) exportSite(dir string, version string) error {
+	if len(version) == 0 {
+		version = "HEAD"
+	}
+	repo, err := this.repo.Open()
+	if err != nil {
+		return err
+	}
+	defer this.repo.Release(repo)
+
+	commit, err := getCommitOfVersion(repo, version)
+	if err != nil || commit == nil {
+		if err == nil {
+			err = errors.New("version " + version + " not found")
+		}
+		return err
+	}
+	defer commit.Free()
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+	defer tree.Free()
+
+	// all files of the tree, the content is read when written
+	files := make(map[string]*git.Oid)
+	err = tree.Walk(func(root string, entry *git.TreeEntry) int {
+		if entry.Type == git.ObjectTree {
+			if strings.ToLower(entry.Name) == ".git" {
+				return 1
+			}
+			return 0
+		}
+		fp := root + entry.Name
+		if entry.Type == git.ObjectBlob && len(this.forbiddenPath(fp)) == 0 && !isReservedPath(fp) {
+			files[fp] = entry.Id
+		}
+		return 0
+	})
+	if err != nil {
+		return err
+	}
+
+	readFile := func(fp string) ([]byte, error) {
+		id, ok := files[fp]
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		blob, err := repo.LookupBlob(id)
+		if err != nil {
+			return nil, err
+		}
+		defer blob.Free()
+		return blob.Contents(), nil
+	}
+	// options, .head and .tail may not be committed, the server reads them from the working tree as well
+	readSidecar := func(fp string) ([]byte, error) {
+		if content, err := readFile(fp); err == nil {
+			return content, nil
+		}
+		return ioutil.ReadFile(this.file(fp))
+	}
+
+	pages := 0
+	needAssets := false
+	for fp := range files {
+		if isExportSidecar(fp, files) {
+			continue
+		}
+		content, err := readFile(fp)
+		if err != nil {
+			return err
+		}
+		target := fp
+		if strings.HasSuffix(fp, ".md") {
+			target = exportPagePath(fp)
+			content = rewriteLinks(content, fp, files)
+
+			head, errh := readSidecar(fp + ".head")
+			tail, errt := readSidecar(fp + ".tail")
+			if errh == nil && errt == nil {
+				// just like the view of the server, the page is wrapped by the custom head and tail
+				content = bytes.Join([][]byte{head, content, tail}, nil)
+			} else {
+				ctx := RequestContext{
+					Title:         this.Title,
+					Theme:         this.Theme,
+					Toc:           this.Toc,
+					HeadingNumber: this.HeadingNumber,
+					Host:          wikiConfig.host,
+					Version:       commit.Id().String(),
+					Export:        true,
+					wiki:          this,
+					path:          fp,
+				}
+				if option, err := readSidecar(optionFile(fp)); err == nil {
+					ctx.applyOption(option)
+				}
+				if isLocalPath(ctx.Host) {
+					// assets are copied into the site
+					needAssets = true
+					ctx.Host = relativeLink(fp, strings.TrimPrefix(ctx.Host, "/"))
+				}
+				ctx.Content = template.HTML(content)
+				var buf bytes.Buffer
+				if err = templates["view"].Execute(&buf, &ctx); err != nil {
+					return err
+				}
+				content = buf.Bytes()
+			}
+			pages++
+		}
+		if err = writeExportFile(dir, target, content); err != nil {
+			return err
+		}
+		if wikiConfig.verbose {
+			log.Printf("[ DEBUG ] export: %s", target)
+		}
+	}
+
+	if needAssets {
+		host := strings.Trim(wikiConfig.host, "/")
+		for _, name := range AssetNames() {
+			if !strings.HasPrefix(name, "_static/") || strings.HasSuffix(name, ".html") || name == "_static/.md" {
+				// the templates and the default page are not needed
+				continue
+			}
+			asset, err := Asset(name)
+			if err != nil {
+				return err
+			}
+			if err = writeExportFile(dir, path.Join(host, strings.TrimPrefix(name, "_static/")), asset); err != nil {
+				return err
+			}
+		}
+	}
+	log.Printf("exported %d pages and %d files at %s to %s", pages, len(files)-pages, commit.Id(), dir)
+	return nil
+}
+
+func writeExportFile(dir string, fp string, content []byte) error {
+	target := filepath.Join(dir, filepath.FromSlash(fp))
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(target, content, 0644)
+}
+
+// the option file, .head and .tail of a page are used for rendering, not exported
+func isExportSidecar(fp string, files map[string]*git.Oid) bool {
+	for _, suffix := range []string{wikiConfig.optext, ".head", ".tail"} {
+		if len(suffix) > 0 && strings.HasSuffix(fp, suffix) {
+			if _, ok := files[strings.TrimSuffix(fp, suffix)]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// a.md is exported as a.html, and dir/.md, the page of dir/, as dir/index.html
+func exportPagePath(fp string) string {
+	name := strings.TrimSuffix(fp, ".md")
+	if len(name) == 0 || strings.HasSuffix(name, "/") {
+		return name + "index.html"
+	}
+	return name + ".html"
+}
+
+func isLocalPath(link string) bool {
+	return strings.HasPrefix(link, "/") && !strings.HasPrefix(link, "//")
+}
+
+// link from the page to target, both are relative to the site root
+func relativeLink(page string, target string) string {
+	rel, err := filepath.Rel(path.Dir("/"+page), "/"+target)
+	if err != nil {
+		return target
+	}
+	rel = filepath.ToSlash(rel)
+	if strings.HasSuffix(target, "/") && !strings.HasSuffix(rel, "/") {
+		rel += "/"
+	}
+	return rel
+}
+
+// rewrite links in the markdown of page to the exported files, other links are left alone
+func rewriteLinks(content []byte, page string, files map[string]*git.Oid) []byte {
+	for _, re := range []*regexp.Regexp{exportInlineLinkRe, exportRefLinkRe, exportAttrLinkRe} {
+		content = re.ReplaceAllFunc(content, func(match []byte) []byte {
+			m := re.FindSubmatch(match)
+			return append(append([]byte{}, m[1]...), exportLink(string(m[2]), page, files)...)
+		})
+	}
+	return content
+}
+
+func exportLink(link string, page string, files map[string]*git.Oid) string {
+	if len(link) == 0 || strings.HasPrefix(link, "#") || strings.HasPrefix(link, "//") || exportSchemeRe.MatchString(link) {
+		return link
+	}
+	target, fragment := link, ""
+	if i := strings.IndexByte(target, '#'); i >= 0 {
+		target, fragment = target[:i], target[i:]
+	}
+	if i := strings.IndexByte(target, '?'); i >= 0 {
+		// the views of the server, e.g. ?history, are not exported
+		target = target[:i]
+	}
+	if unescaped, err := url.PathUnescape(target); err == nil {
+		target = unescaped
+	}
+	if !strings.HasPrefix(target, "/") {
+		target = path.Dir("/"+page) + "/" + target
+	}
+	dir := strings.HasSuffix(target, "/")
+	target = strings.TrimPrefix(path.Clean(target), "/")
+	if dir && len(target) > 0 {
+		target += "/"
+	}
+
+	if _, ok := files[target+".md"]; ok {
+		target = exportPagePath(target + ".md")
+	} else if _, ok := files[target]; ok {
+		if strings.HasSuffix(target, ".md") {
+			target = exportPagePath(target)
+		}
+	} else {
+		return link
+	}
+	u := url.URL{Path: relativeLink(page, target)}
+	return u.String() + fragment
+}
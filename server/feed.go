@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// atom and rss feeds of the recent changes
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	Title   string     `xml:"title"`
+	Id      string     `xml:"id"`
+	Updated string     `xml:"updated"`
+	Author  atomAuthor `xml:"author"`
+	Link    atomLink   `xml:"link"`
+	Summary string     `xml:"summary"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	Id      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type rssGuid struct {
+	Value       string `xml:",chardata"`
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	Guid        rssGuid `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+	Description string  `xml:"description"`
+}
+
+type rssChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	Items       []rssItem `xml:"item"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+// absolute url of the wiki, feed readers need it
+func (this *RequestContext) baseURL() string {
+	scheme := "http"
+	if this.req.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + this.req.Host
+}
+
+// the page of the changed file at the commit, or the whole commit if more files changed
+func (this *RequestContext) changeLink(change *ChangeEntry) string {
+	if len(change.Files) != 1 {
+		return this.baseURL() + this.Prefix + "/?commit=" + change.Id
+	}
+	return this.baseURL() + this.Prefix + change.FileLink(change.Files[0])
+}
+
+func changeTitle(change *ChangeEntry) string {
+	return strings.SplitN(strings.TrimSpace(change.Message), "\n", 2)[0]
+}
+
+func changeSummary(change *ChangeEntry) string {
+	return strings.TrimSpace(change.Message) + "\n\n" + strings.Join(change.Files, "\n")
+}
+
+func (this *RequestContext) changesURL() string {
+	u := url.URL{Path: "/" + this.path}
+	if len(this.path) > 0 {
+		u.Path += "/"
+	}
+	return this.baseURL() + this.Prefix + u.String() + "?changes"
+}
+
+func (this *RequestContext) writeAtom(changes []ChangeEntry) error {
+	feed := atomFeed{
+		Title: this.Title + " - recent changes",
+		Id:    this.changesURL(),
+		Links: []atomLink{
+			{Href: this.changesURL()},
+			{Href: this.baseURL() + this.req.URL.RequestURI(), Rel: "self"},
+		},
+	}
+	updated := time.Now()
+	if len(changes) > 0 {
+		updated = changes[0].Timestamp
+	}
+	feed.Updated = updated.Format(time.RFC3339)
+	for i := range changes {
+		change := &changes[i]
+		feed.Entries = append(feed.Entries, atomEntry{
+			Title:   changeTitle(change),
+			Id:      "urn:sha1:" + change.Id,
+			Updated: change.Timestamp.Format(time.RFC3339),
+			Author:  atomAuthor{Name: change.Author},
+			Link:    atomLink{Href: this.changeLink(change)},
+			Summary: changeSummary(change),
+		})
+	}
+	return this.writeXML("application/atom+xml; charset=utf-8", feed)
+}
+
+func (this *RequestContext) writeRSS(changes []ChangeEntry) error {
+	feed := rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:       this.Title + " - recent changes",
+			Link:        this.changesURL(),
+			Description: "recent changes of " + this.Title,
+		},
+	}
+	for i := range changes {
+		change := &changes[i]
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title:       changeTitle(change),
+			Link:        this.changeLink(change),
+			Guid:        rssGuid{Value: change.Id},
+			PubDate:     change.Timestamp.Format(time.RFC1123Z),
+			Description: changeSummary(change),
+		})
+	}
+	return this.writeXML("application/rss+xml; charset=utf-8", feed)
+}
+
+func (this *RequestContext) writeXML(contentType string, v interface{}) error {
+	w := *this.res
+	w.Header().Set("Content-Type", contentType)
+	this.statusCode = http.StatusOK
+	if _, err := w.Write([]byte(xml.Header)); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	return encoder.Encode(v)
+}
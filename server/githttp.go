@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/libgit2/git2go"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// git smart http protocol, so that `git clone http://wiki/` works without any other service
+// clone/fetch/push are served by libgit2, no git binary is executed
+
+const ZERO_OID = "0000000000000000000000000000000000000000"
+
+// check if the request is one of the smart http endpoints
+// they are served at the root, and under /.git/ as well
+func gitHTTPService(r *http.Request, fp string) (service string, advertise bool) {
+	fp = strings.TrimPrefix(fp, ".git/")
+	if fp == "info/refs" && r.Method == "GET" {
+		service = r.URL.Query().Get("service")
+		if service == "git-upload-pack" || service == "git-receive-pack" {
+			return service, true
+		}
+		return "", false
+	}
+	if (fp == "git-upload-pack" || fp == "git-receive-pack") && r.Method == "POST" &&
+		r.Header.Get("Content-Type") == "application/x-"+fp+"-request" {
+		return fp, false
+	}
+	return "", false
+}
+
+func writePktLine(w io.Writer, s string) {
+	fmt.Fprintf(w, "%04x%s", len(s)+4, s)
+}
+
+func writePktFlush(w io.Writer) {
+	io.WriteString(w, "0000")
+}
+
+// read a pkt-line without the trailing LF, flush-pkt is returned as empty string
+func readPktLine(r *bufio.Reader) (string, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return "", err
+	}
+	n, err := strconv.ParseUint(string(hdr[:]), 16, 16)
+	if err != nil {
+		return "", errors.New("bad pkt-line length " + string(hdr[:]))
+	}
+	if n == 0 {
+		return "", nil
+	}
+	if n < 4 {
+		return "", errors.New("bad pkt-line length " + string(hdr[:]))
+	}
+	buf := make([]byte, n-4)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(buf), "\n"), nil
+}
+
+func (this *RequestContext) GitHTTP(service string, advertise bool) error {
+	w := *this.res
+	w.Header().Set("Cache-Control", "no-cache, max-age=0, must-revalidate")
+
+	// clone and fetch are reads, but push changes the wiki
+	if service == "git-receive-pack" && len(wikiConfig.googleauth) > 0 &&
+		(!this.gauthStatus || encrypt_sig(this.gusername, this.gmailaddr, encrypt_key) != this.signature) {
+		this.statusCode = http.StatusForbidden
+		return errors.New("push is not allowed without authentication")
+	}
+
+	repo, err := this.wiki.repo.Open()
+	if err != nil {
+		this.statusCode = http.StatusInternalServerError
+		return err
+	}
+	defer this.wiki.repo.Release(repo)
+
+	if advertise {
+		w.Header().Set("Content-Type", "application/x-"+service+"-advertisement")
+		writePktLine(w, "# service="+service+"\n")
+		writePktFlush(w)
+		return advertiseRefs(w, repo, service)
+	}
+
+	body := this.req.Body
+	if this.req.Header.Get("Content-Encoding") == "gzip" {
+		body, err = gzip.NewReader(this.req.Body)
+		if err != nil {
+			this.statusCode = http.StatusBadRequest
+			return err
+		}
+	}
+	reader := bufio.NewReader(body)
+
+	if service == "git-upload-pack" {
+		return this.uploadPack(repo, reader)
+	}
+	return this.receivePack(repo, reader)
+}
+
+func advertiseRefs(w io.Writer, repo *git.Repository, service string) error {
+	caps := "agent=strapdown/" + SERVER_VERSION
+	if service == "git-upload-pack" {
+		caps = "ofs-delta " + caps
+		if branch, err := headBranch(repo); err == nil {
+			caps = "symref=HEAD:" + branch + " " + caps
+		}
+	} else {
+		caps = "report-status delete-refs " + caps
+	}
+
+	var lines []string
+	if service == "git-upload-pack" {
+		if head, err := repo.Head(); err == nil {
+			lines = append(lines, head.Target().String()+" HEAD")
+			head.Free()
+		}
+	}
+
+	iter, err := repo.NewReferenceIterator()
+	if err != nil {
+		return err
+	}
+	defer iter.Free()
+	for {
+		ref, err := iter.Next()
+		if err != nil {
+			break
+		}
+		name := ref.Name()
+		if ref.Type() != git.ReferenceOid || !(strings.HasPrefix(name, "refs/heads/") || strings.HasPrefix(name, "refs/tags/")) {
+			ref.Free()
+			continue
+		}
+		lines = append(lines, ref.Target().String()+" "+name)
+		if ref.IsTag() {
+			// peeled annotated tags
+			if obj, err := ref.Peel(git.ObjectCommit); err == nil {
+				if !obj.Id().Equal(ref.Target()) {
+					lines = append(lines, obj.Id().String()+" "+name+"^{}")
+				}
+				obj.Free()
+			}
+		}
+		ref.Free()
+	}
+
+	if len(lines) == 0 {
+		lines = append(lines, ZERO_OID+" capabilities^{}")
+	}
+	for i, line := range lines {
+		if i == 0 {
+			line += "\x00" + caps
+		}
+		writePktLine(w, line+"\n")
+	}
+	writePktFlush(w)
+	return nil
+}
+
+// stateless upload-pack, without multi_ack the first common commit is acked
+func (this *RequestContext) uploadPack(repo *git.Repository, reader *bufio.Reader) error {
+	var wants, haves []*git.Oid
+	done := false
+	for {
+		line, err := readPktLine(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			this.statusCode = http.StatusBadRequest
+			return err
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "want", "have":
+			if len(fields) < 2 {
+				continue
+			}
+			oid, err := git.NewOid(fields[1])
+			if err != nil {
+				this.statusCode = http.StatusBadRequest
+				return err
+			}
+			if fields[0] == "want" {
+				wants = append(wants, oid)
+			} else if _, err := repo.Lookup(oid); err == nil {
+				haves = append(haves, oid)
+			}
+		case "done":
+			done = true
+		}
+		if done {
+			break
+		}
+	}
+
+	w := *this.res
+	w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+	if len(haves) > 0 {
+		writePktLine(w, "ACK "+haves[0].String()+"\n")
+	} else {
+		writePktLine(w, "NAK\n")
+	}
+	if !done || len(wants) == 0 {
+		return nil
+	}
+
+	walk, err := repo.Walk()
+	if err != nil {
+		return err
+	}
+	defer walk.Free()
+
+	pb, err := repo.NewPackbuilder()
+	if err != nil {
+		return err
+	}
+	defer pb.Free()
+
+	for _, oid := range wants {
+		obj, err := repo.Lookup(oid)
+		if err != nil {
+			return err
+		}
+		if obj.Type() == git.ObjectTag {
+			// the tag object itself, then the commit it points to
+			if err = pb.Insert(oid, ""); err != nil {
+				return err
+			}
+			peeled, err := obj.Peel(git.ObjectCommit)
+			if err != nil {
+				return err
+			}
+			oid = peeled.Id()
+		}
+		if err = walk.Push(oid); err != nil {
+			return err
+		}
+	}
+	for _, oid := range haves {
+		walk.Hide(oid)
+	}
+	if err = pb.InsertWalk(walk); err != nil {
+		return err
+	}
+	if wikiConfig.verbose {
+		log.Printf("[ DEBUG ] upload-pack %d objects", pb.ObjectCount())
+	}
+	return pb.Write(w)
+}
+
+type refUpdate struct {
+	old  *git.Oid
+	new  *git.Oid
+	name string
+	err  string
+}
+
+// receive-pack with report-status, the working tree follows the current branch
+func (this *RequestContext) receivePack(repo *git.Repository, reader *bufio.Reader) error {
+	var updates []*refUpdate
+	for {
+		line, err := readPktLine(reader)
+		if err != nil {
+			this.statusCode = http.StatusBadRequest
+			return err
+		}
+		if len(line) == 0 {
+			break
+		}
+		if i := strings.IndexByte(line, 0); i >= 0 {
+			line = line[:i] // capabilities
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			this.statusCode = http.StatusBadRequest
+			return errors.New("bad receive-pack command: " + line)
+		}
+		oldOid, err := git.NewOid(fields[0])
+		if err != nil {
+			this.statusCode = http.StatusBadRequest
+			return err
+		}
+		newOid, err := git.NewOid(fields[1])
+		if err != nil {
+			this.statusCode = http.StatusBadRequest
+			return err
+		}
+		updates = append(updates, &refUpdate{old: oldOid, new: newOid, name: fields[2]})
+	}
+
+	unpack := "ok"
+	if _, err := reader.Peek(1); err == nil {
+		if err = receivePackfile(repo, reader); err != nil {
+			unpack = err.Error()
+		}
+	}
+
+	w := *this.res
+	w.Header().Set("Content-Type", "application/x-git-receive-pack-result")
+	writePktLine(w, "unpack "+unpack+"\n")
+
+	changed := false
+	for _, update := range updates {
+		if unpack != "ok" {
+			update.err = "unpacker error"
+		} else if err := this.updateRef(repo, update); err != nil {
+			update.err = err.Error()
+		}
+		if len(update.err) > 0 {
+			writePktLine(w, "ng "+update.name+" "+update.err+"\n")
+		} else {
+			writePktLine(w, "ok "+update.name+"\n")
+			changed = true
+		}
+	}
+	writePktFlush(w)
+
+	if changed {
+		this.wiki.requestPush()
+	}
+	return nil
+}
+
+func receivePackfile(repo *git.Repository, reader io.Reader) error {
+	odb, err := repo.Odb()
+	if err != nil {
+		return err
+	}
+	writepack, err := odb.NewWritePack(nil)
+	if err != nil {
+		return err
+	}
+	defer writepack.Free()
+	if _, err = io.Copy(writepack, reader); err != nil {
+		return err
+	}
+	return writepack.Commit()
+}
+
+func (this *RequestContext) updateRef(repo *git.Repository, update *refUpdate) error {
+	if !strings.HasPrefix(update.name, "refs/heads/") && !strings.HasPrefix(update.name, "refs/tags/") {
+		return errors.New("only branches and tags can be pushed")
+	}
+	branch, _ := headBranch(repo)
+
+	return this.wiki.repo.Write(func(repo *git.Repository, index *git.Index) error {
+		current := ZERO_OID
+		if ref, err := repo.References.Lookup(update.name); err == nil {
+			current = ref.Target().String()
+			ref.Free()
+		}
+		if current != update.old.String() {
+			return errors.New("stale info")
+		}
+
+		author, _ := this.author()
+		msg := "push by " + author
+		if update.new.IsZero() {
+			if update.name == branch {
+				return errors.New("deletion of the current branch prohibited")
+			}
+			ref, err := repo.References.Lookup(update.name)
+			if err != nil {
+				return err
+			}
+			defer ref.Free()
+			return ref.Delete()
+		}
+
+		if strings.HasPrefix(update.name, "refs/heads/") {
+			if _, err := repo.LookupCommit(update.new); err != nil {
+				return errors.New("not a commit")
+			}
+			if !update.old.IsZero() {
+				// wiki history should never be rewritten
+				base, err := repo.MergeBase(update.old, update.new)
+				if err != nil || !base.Equal(update.old) {
+					return errors.New("non-fast-forward")
+				}
+			}
+			// the pushed files are served right away or once the draft is merged,
+			// so they go through the checks of an edit; a new branch is checked from where it forks
+			base := update.old
+			if base.IsZero() {
+				if head, err := repo.Head(); err == nil {
+					if fork, err := repo.MergeBase(head.Target(), update.new); err == nil {
+						base = fork
+					}
+					head.Free()
+				}
+			}
+			if err := this.wiki.checkPushedFiles(repo, base, update.new); err != nil {
+				return err
+			}
+			if update.name == branch {
+				// so that the served pages reflect the push
+				return updateBranch(repo, branch, update.new, msg)
+			}
+		}
+		ref, err := repo.References.Create(update.name, update.new, true, msg)
+		if err != nil {
+			return err
+		}
+		ref.Free()
+		return nil
+	})
+}
+
+// every file changed from old to new must be one that could be written through the wiki
+func (this *Wiki) checkPushedFiles(repo *git.Repository, old *git.Oid, new *git.Oid) error {
+	commit, err := repo.LookupCommit(new)
+	if err != nil {
+		return err
+	}
+	defer commit.Free()
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+	defer tree.Free()
+
+	// a new branch is compared with the empty tree
+	var oldTree *git.Tree
+	if !old.IsZero() {
+		oldCommit, err := repo.LookupCommit(old)
+		if err != nil {
+			return err
+		}
+		defer oldCommit.Free()
+		if oldTree, err = oldCommit.Tree(); err != nil {
+			return err
+		}
+		defer oldTree.Free()
+	}
+
+	diff, err := repo.DiffTreeToTree(oldTree, tree, nil)
+	if err != nil {
+		return err
+	}
+	defer diff.Free()
+	n, err := diff.NumDeltas()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		delta, err := diff.Delta(i)
+		if err != nil {
+			return err
+		}
+		for _, fp := range []string{delta.OldFile.Path, delta.NewFile.Path} {
+			if reason := this.forbiddenPath(fp); len(reason) > 0 {
+				return errors.New(reason + ": " + fp)
+			}
+			if isReservedPath(fp) {
+				return errors.New("cannot write to reserved path " + fp)
+			}
+		}
+		if delta.Status == git.DeltaDeleted || !strings.HasSuffix(delta.NewFile.Path, ".md") {
+			continue
+		}
+		blob, err := repo.LookupBlob(delta.NewFile.Oid)
+		if err != nil {
+			return err
+		}
+		xmp := bytes.Contains(blob.Contents(), []byte("</xmp>"))
+		blob.Free()
+		if xmp {
+			return errors.New(delta.NewFile.Path + " contains </xmp>, which will break strapdown system")
+		}
+	}
+	return nil
+}
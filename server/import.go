@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// -import replays the history of a MediaWiki xml dump or a DokuWiki data directory,
+// every revision becomes a commit with the original author and time, pages are converted to markdown
+
+const (
+	IMPORT_MEDIAWIKI = "mediawiki"
+	IMPORT_DOKUWIKI  = "dokuwiki"
+)
+
+type importRevision struct {
+	Path    string // the .md file, relative to the wiki root
+	Author  string
+	Time    time.Time
+	Comment string
+	Minor   bool
+	Deleted bool
+	Content []byte
+}
+
+func (this *Wiki) importWiki(src string, format string) error {
+	if len(format) == 0 {
+		// a dump file or a data directory
+		format = IMPORT_MEDIAWIKI
+		if stat, err := os.Stat(src); err == nil && stat.IsDir() {
+			format = IMPORT_DOKUWIKI
+		}
+	}
+	var revisions []importRevision
+	var err error
+	switch format {
+	case IMPORT_MEDIAWIKI:
+		revisions, err = readMediaWiki(src)
+	case IMPORT_DOKUWIKI:
+		revisions, err = readDokuWiki(src)
+	default:
+		err = errors.New("unknown import format " + format + ", should be " + IMPORT_MEDIAWIKI + " or " + IMPORT_DOKUWIKI)
+	}
+	if err != nil {
+		return err
+	}
+
+	// the history of all pages is replayed in order
+	sort.SliceStable(revisions, func(i, j int) bool {
+		return revisions[i].Time.Before(revisions[j].Time)
+	})
+	for i, revision := range revisions {
+		if reason := this.forbiddenPath(revision.Path); len(reason) > 0 || isReservedPath(revision.Path) {
+			log.Printf("[ WARN ] skip %s: not allowed", revision.Path)
+			continue
+		}
+		if strings.HasSuffix(revision.Path, ".md") && bytes.Contains(revision.Content, []byte("</xmp>")) {
+			// the page could not be rendered, just like an edit containing it is refused
+			log.Printf("[ WARN ] skip revision of %s at %v: </xmp> is not allowed in a page", revision.Path, revision.Time)
+			continue
+		}
+		author, email := revision.Author, DEFAULT_AUTHOR_EMAIL
+		if user, ok := this.users.Lookup(author); ok {
+			if len(user.Name) > 0 {
+				author = user.Name
+			}
+			email = user.Email
+		}
+		comment := strings.TrimSpace(revision.Comment)
+		if len(comment) == 0 {
+			comment = "import " + revision.Path + " from " + format
+		}
+		comment = buildCommitMessage(comment, revision.Minor)
+
+		if revision.Deleted {
+			err = this.removeAndCommitAt([]string{revision.Path}, comment, author, email, revision.Time)
+		} else {
+			err = this.saveAndCommitAt(revision.Path, revision.Content, comment, author, email, revision.Time)
+		}
+		if err != nil {
+			return fmt.Errorf("%s at %v: %v", revision.Path, revision.Time, err)
+		}
+		if wikiConfig.verbose {
+			log.Printf("[ DEBUG ] import %d/%d: %s by %s at %v", i+1, len(revisions), revision.Path, author, revision.Time)
+		}
+	}
+	log.Printf("imported %d revisions from %s", len(revisions), src)
+	return nil
+}
+
+// the file of a page title, subpages and namespaces become directories
+func importPagePath(title string) string {
+	title = strings.Replace(strings.TrimSpace(title), " ", "_", -1)
+	title = strings.Replace(title, ":", "/", -1)
+	title = strings.Trim(path.Clean("/"+title), "/")
+	if len(title) == 0 {
+		// the main page of the wiki
+		return ".md"
+	}
+	return title + ".md"
+}
+
+// mediawiki
+
+type mediaWikiRevision struct {
+	Timestamp string    `xml:"timestamp"`
+	Username  string    `xml:"contributor>username"`
+	IP        string    `xml:"contributor>ip"`
+	Comment   string    `xml:"comment"`
+	Minor     *struct{} `xml:"minor"`
+	Text      string    `xml:"text"`
+}
+
+type mediaWikiPage struct {
+	Title     string              `xml:"title"`
+	Revisions []mediaWikiRevision `xml:"revision"`
+}
+
+func readMediaWiki(fp string) ([]importRevision, error) {
+	file, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var revisions []importRevision
+	decoder := xml.NewDecoder(bufio.NewReader(file))
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "page" {
+			continue
+		}
+		var page mediaWikiPage
+		if err = decoder.DecodeElement(&page, &start); err != nil {
+			return nil, err
+		}
+		for _, revision := range page.Revisions {
+			when, err := time.Parse(time.RFC3339, revision.Timestamp)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", page.Title, err)
+			}
+			author := revision.Username
+			if len(author) == 0 {
+				author = revision.IP
+			}
+			revisions = append(revisions, importRevision{
+				Path:    importPagePath(page.Title),
+				Author:  author,
+				Time:    when,
+				Comment: revision.Comment,
+				Minor:   revision.Minor != nil,
+				Content: []byte(mediaWikiToMarkdown(revision.Text)),
+			})
+		}
+	}
+	return revisions, nil
+}
+
+var (
+	mediaWikiHeadingRe  = regexp.MustCompile(`(?m)^(={1,6})[ \t]*(.+?)[ \t]*={1,6}[ \t]*$`)
+	mediaWikiBoldItalic = regexp.MustCompile(`'''''(.+?)'''''`)
+	mediaWikiBoldRe     = regexp.MustCompile(`'''(.+?)'''`)
+	mediaWikiItalicRe   = regexp.MustCompile(`''(.+?)''`)
+	mediaWikiLinkRe     = regexp.MustCompile(`\[\[([^\[\]|]+)(?:\|([^\[\]]*))?\]\]`)
+	mediaWikiExtLinkRe  = regexp.MustCompile(`\[((?:https?|ftp|mailto):[^\s\]]+)(?:\s+([^\]]*))?\]`)
+	mediaWikiListRe     = regexp.MustCompile(`(?m)^([*#]+)[ \t]*`)
+	mediaWikiPreRe      = regexp.MustCompile(`(?s)<pre>\n?(.*?)\n?</pre>`)
+	mediaWikiCodeRe     = regexp.MustCompile(`<code>(.*?)</code>`)
+)
+
+// the common syntax of mediawiki, anything else, e.g. templates and tables, is kept as it is
+func mediaWikiToMarkdown(text string) string {
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	var blocks importCodeBlocks
+	text = blocks.extract(text, mediaWikiPreRe, "```\n$1\n```")
+	text = blocks.extract(text, mediaWikiCodeRe, "`$1`")
+	// before the headings and the bold text, which start with the same marks in markdown
+	text = mediaWikiListRe.ReplaceAllStringFunc(text, func(prefix string) string {
+		marks := strings.TrimSpace(prefix)
+		item := "- "
+		if strings.HasSuffix(marks, "#") {
+			item = "1. "
+		}
+		return strings.Repeat("   ", len(marks)-1) + item
+	})
+	text = mediaWikiHeadingRe.ReplaceAllStringFunc(text, func(line string) string {
+		m := mediaWikiHeadingRe.FindStringSubmatch(line)
+		return strings.Repeat("#", len(m[1])) + " " + m[2]
+	})
+	text = mediaWikiBoldItalic.ReplaceAllString(text, "***$1***")
+	text = mediaWikiBoldRe.ReplaceAllString(text, "**$1**")
+	text = mediaWikiItalicRe.ReplaceAllString(text, "*$1*")
+	text = mediaWikiLinkRe.ReplaceAllStringFunc(text, func(link string) string {
+		m := mediaWikiLinkRe.FindStringSubmatch(link)
+		title, label := m[1], m[2]
+		if len(label) == 0 {
+			label = title
+		}
+		anchor := ""
+		if i := strings.IndexByte(title, '#'); i >= 0 {
+			title, anchor = title[:i], title[i:]
+		}
+		return "[" + label + "](" + importLinkTarget(importPagePath(title)) + anchor + ")"
+	})
+	text = mediaWikiExtLinkRe.ReplaceAllStringFunc(text, func(link string) string {
+		m := mediaWikiExtLinkRe.FindStringSubmatch(link)
+		if len(m[2]) == 0 {
+			return "<" + m[1] + ">"
+		}
+		return "[" + m[2] + "](" + m[1] + ")"
+	})
+	return blocks.restore(text)
+}
+
+var importCodePlaceholderRe = regexp.MustCompile("\x00([0-9]+)\x00")
+
+// code is kept as it is, the blocks are replaced with placeholders before the conversion and put back after it
+type importCodeBlocks []string
+
+// replace the matches of re with template, as ReplaceAllString does, and take them out of text
+func (this *importCodeBlocks) extract(text string, re *regexp.Regexp, template string) string {
+	return re.ReplaceAllStringFunc(text, func(block string) string {
+		var code []byte
+		code = re.ExpandString(code, template, block, re.FindStringSubmatchIndex(block))
+		*this = append(*this, string(code))
+		return fmt.Sprintf("\x00%d\x00", len(*this)-1)
+	})
+}
+
+func (this importCodeBlocks) restore(text string) string {
+	return importCodePlaceholderRe.ReplaceAllStringFunc(text, func(placeholder string) string {
+		i, _ := strconv.Atoi(placeholder[1 : len(placeholder)-1])
+		return this[i]
+	})
+}
+
+// the url of an imported page
+func importLinkTarget(fp string) string {
+	return "/" + strings.TrimSuffix(strings.Replace(fp, " ", "%20", -1), ".md")
+}
+
+// dokuwiki
+
+// the revisions of a page are listed in data/meta/<id>.changes, old versions are kept in data/attic
+func readDokuWiki(dir string) ([]importRevision, error) {
+	pagesDir := filepath.Join(dir, "pages")
+	if _, err := os.Stat(pagesDir); err != nil {
+		// the wiki root instead of the data directory
+		dir = filepath.Join(dir, "data")
+		pagesDir = filepath.Join(dir, "pages")
+	}
+	if _, err := os.Stat(pagesDir); err != nil {
+		return nil, errors.New("no pages found in the dokuwiki data directory " + dir)
+	}
+
+	var revisions []importRevision
+	seen := make(map[string]bool)
+	err := filepath.Walk(filepath.Join(dir, "meta"), func(fp string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.HasSuffix(fp, ".changes") {
+			return nil
+		}
+		rel, err := filepath.Rel(filepath.Join(dir, "meta"), strings.TrimSuffix(fp, ".changes"))
+		if err != nil {
+			return err
+		}
+		page := filepath.ToSlash(rel)
+		if strings.HasPrefix(page, "_") {
+			// e.g. _dokuwiki.changes, the log of the whole wiki
+			return nil
+		}
+		pageRevisions, err := readDokuWikiChanges(dir, page, fp)
+		if err != nil {
+			return err
+		}
+		seen[page] = true
+		revisions = append(revisions, pageRevisions...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// pages without any change log, e.g. copied in by hand
+	err = filepath.Walk(pagesDir, func(fp string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.HasSuffix(fp, ".txt") {
+			return nil
+		}
+		rel, err := filepath.Rel(pagesDir, strings.TrimSuffix(fp, ".txt"))
+		if err != nil {
+			return err
+		}
+		page := filepath.ToSlash(rel)
+		if seen[page] {
+			return nil
+		}
+		content, err := ioutil.ReadFile(fp)
+		if err != nil {
+			return err
+		}
+		revisions = append(revisions, importRevision{
+			Path:    importPagePath(page),
+			Author:  "anonymous",
+			Time:    info.ModTime(),
+			Content: []byte(dokuWikiToMarkdown(string(content))),
+		})
+		return nil
+	})
+	return revisions, err
+}
+
+// a line of the change log: timestamp, ip, type, id, user, summary, extra
+func readDokuWikiChanges(dir string, page string, fp string) ([]importRevision, error) {
+	file, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var revisions []importRevision
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 6 {
+			continue
+		}
+		timestamp, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		revision := importRevision{
+			Path:    importPagePath(page),
+			Author:  fields[4],
+			Time:    time.Unix(timestamp, 0),
+			Comment: fields[5],
+			Minor:   fields[2] == "e",
+			Deleted: fields[2] == "D",
+		}
+		if len(revision.Author) == 0 {
+			revision.Author = fields[1]
+		}
+		if !revision.Deleted {
+			content, err := readDokuWikiRevision(dir, page, fields[0])
+			if err != nil {
+				log.Printf("[ WARN ] skip revision %s of %s: %v", fields[0], page, err)
+				continue
+			}
+			revision.Content = []byte(dokuWikiToMarkdown(string(content)))
+		}
+		revisions = append(revisions, revision)
+	}
+	return revisions, scanner.Err()
+}
+
+// an old revision from the attic, the latest one may only be in pages
+func readDokuWikiRevision(dir string, page string, timestamp string) ([]byte, error) {
+	name := filepath.FromSlash(page)
+	file, err := os.Open(filepath.Join(dir, "attic", name+"."+timestamp+".txt.gz"))
+	if err == nil {
+		defer file.Close()
+		reader, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return ioutil.ReadAll(reader)
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(dir, "attic", name+"."+timestamp+".txt")); err == nil {
+		return content, nil
+	}
+	fp := filepath.Join(dir, "pages", name+".txt")
+	stat, err := os.Stat(fp)
+	if err != nil {
+		return nil, err
+	}
+	if strconv.FormatInt(stat.ModTime().Unix(), 10) != timestamp {
+		return nil, errors.New("not found in the attic")
+	}
+	return ioutil.ReadFile(fp)
+}
+
+var (
+	dokuWikiHeadingRe   = regexp.MustCompile(`(?m)^[ \t]*(={2,6})[ \t]*(.+?)[ \t]*={2,6}[ \t]*$`)
+	dokuWikiItalicRe    = regexp.MustCompile(`(^|[^:])//(.+?[^:])//`)
+	dokuWikiUnderlineRe = regexp.MustCompile(`__(.+?)__`)
+	dokuWikiMonoRe      = regexp.MustCompile(`''(.+?)''`)
+	dokuWikiLinkRe      = regexp.MustCompile(`\[\[([^\[\]|]+)(?:\|([^\[\]]*))?\]\]`)
+	dokuWikiListRe      = regexp.MustCompile(`(?m)^((?:  )+)([*-])[ \t]*`)
+	dokuWikiCodeRe      = regexp.MustCompile(`(?s)<(code|file)(?:\s+([\w-]+))?[^>]*>\n?(.*?)\n?</(?:code|file)>`)
+	dokuWikiURLRe       = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*:`)
+)
+
+// the common syntax of dokuwiki, anything else is kept as it is
+func dokuWikiToMarkdown(text string) string {
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	var blocks importCodeBlocks
+	text = blocks.extract(text, dokuWikiCodeRe, "```$2\n$3\n```")
+	text = dokuWikiHeadingRe.ReplaceAllStringFunc(text, func(line string) string {
+		m := dokuWikiHeadingRe.FindStringSubmatch(line)
+		// ====== is the top level
+		return strings.Repeat("#", 7-len(m[1])) + " " + m[2]
+	})
+	text = dokuWikiLinkRe.ReplaceAllStringFunc(text, func(link string) string {
+		m := dokuWikiLinkRe.FindStringSubmatch(link)
+		target, label := strings.TrimSpace(m[1]), m[2]
+		if len(label) == 0 {
+			label = target
+		}
+		if dokuWikiURLRe.MatchString(target) && !strings.Contains(target, "://") && !strings.HasPrefix(target, "mailto:") {
+			// a namespace, e.g. [[wiki:syntax]], not an url
+			target = importLinkTarget(importPagePath(target))
+		} else if !dokuWikiURLRe.MatchString(target) {
+			anchor := ""
+			if i := strings.IndexByte(target, '#'); i >= 0 {
+				target, anchor = target[:i], target[i:]
+			}
+			target = importLinkTarget(importPagePath(target)) + anchor
+		}
+		return "[" + label + "](" + target + ")"
+	})
+	text = dokuWikiItalicRe.ReplaceAllString(text, "$1*$2*")
+	text = dokuWikiUnderlineRe.ReplaceAllString(text, "<u>$1</u>")
+	text = dokuWikiMonoRe.ReplaceAllString(text, "`$1`")
+	text = dokuWikiListRe.ReplaceAllStringFunc(text, func(prefix string) string {
+		m := dokuWikiListRe.FindStringSubmatch(prefix)
+		item := "- "
+		if m[2] == "-" {
+			item = "1. "
+		}
+		return strings.Repeat("   ", len(m[1])/2-1) + item
+	})
+	return blocks.restore(text)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	auth "github.com/abbot/go-http-auth"
+	"github.com/libgit2/git2go"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// the server hosts the default wiki at / and more wikis mounted under url prefixes with -mounts, e.g.
+//
+//	[
+//		{"Prefix": "/infra/", "Dir": "/srv/infra-wiki", "Title": "Infra"},
+//		{"Prefix": "/sec/", "Dir": "/srv/sec-wiki", "Auth": ".htpasswd"}
+//	]
+//
+// every wiki has its own git repository, auth file, user directory and page defaults,
+// anything not set is taken from the flags of the default wiki
+
+type Wiki struct {
+	Prefix        string // the url prefix with slashes around, / for the default wiki
+	Dir           string // the git working tree, relative to the mounts file
+	Auth          string `json:",omitempty"` // relative to Dir, just like -auth
+	Users         string `json:",omitempty"`
+	Title         string `json:",omitempty"`
+	Theme         string `json:",omitempty"`
+	Toc           string `json:",omitempty"`
+	HeadingNumber string `json:",omitempty"`
+
+	repo          *RepoService
+	users         userDirectory
+	authenticator *auth.BasicAuth
+}
+
+var mainWiki *Wiki // the default wiki at /, sync, -export and -import work on it
+var wikis []*Wiki  // every wiki, the longest prefix first
+
+// the path of fp in the working tree
+func (this *Wiki) file(fp string) string {
+	return filepath.Join(this.Dir, filepath.FromSlash(fp))
+}
+
+// the path of a config file like the auth file, which may be outside of the working tree
+func (this *Wiki) configFile(fp string) string {
+	if filepath.IsAbs(fp) {
+		return fp
+	}
+	return this.file(fp)
+}
+
+// the url of an absolute link of the wiki, e.g. /page becomes /infra/page
+func (this *Wiki) link(u string) string {
+	return strings.TrimSuffix(this.Prefix, "/") + u
+}
+
+// a commit of the default wiki is pushed to the remote, the mounted ones are not synced
+func (this *Wiki) requestPush() {
+	if this == mainWiki {
+		requestPush()
+	}
+}
+
+func loadMounts(fp string) ([]*Wiki, error) {
+	content, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return nil, err
+	}
+	var mounts []*Wiki
+	if err = json.Unmarshal(content, &mounts); err != nil {
+		return nil, errors.New(fp + ": " + err.Error())
+	}
+	seen := make(map[string]bool)
+	for _, wiki := range mounts {
+		prefix := path.Clean("/" + wiki.Prefix)
+		if prefix == "/" || len(mainWiki.forbiddenPath(prefix[1:])) > 0 || isReservedPath(prefix[1:]) {
+			return nil, errors.New(fp + ": bad mount prefix " + wiki.Prefix)
+		}
+		wiki.Prefix = prefix + "/"
+		if seen[wiki.Prefix] {
+			return nil, errors.New(fp + ": " + wiki.Prefix + " is mounted twice")
+		}
+		seen[wiki.Prefix] = true
+		if len(wiki.Dir) == 0 {
+			return nil, errors.New(fp + ": no dir for " + wiki.Prefix)
+		}
+		if !filepath.IsAbs(wiki.Dir) {
+			wiki.Dir = filepath.Join(filepath.Dir(fp), wiki.Dir)
+		}
+	}
+	return mounts, nil
+}
+
+// fill the defaults, then open the repository
+func (this *Wiki) open() error {
+	for _, option := range []struct {
+		value    *string
+		fallback string
+	}{
+		{&this.Auth, wikiConfig.auth},
+		{&this.Users, wikiConfig.users},
+		{&this.Title, wikiConfig.title},
+		{&this.Theme, wikiConfig.theme},
+		{&this.Toc, wikiConfig.toc},
+		{&this.HeadingNumber, wikiConfig.heading_number},
+	} {
+		if len(*option.value) == 0 {
+			*option.value = option.fallback
+		}
+	}
+	if len(this.Users) > 0 {
+		this.users.fp = this.configFile(this.Users)
+	}
+
+	if wikiConfig.init {
+		if repo, err := git.OpenRepository(this.Dir); err != nil {
+			if err = os.MkdirAll(this.Dir, 0755); err != nil {
+				return err
+			}
+			if _, err = git.InitRepository(this.Dir, false); err != nil {
+				return err
+			}
+			log.Printf("git init finished at %s", this.Dir)
+		} else {
+			log.Printf("git repository already found at %s, skip git init", this.Dir)
+			repo.Free()
+		}
+	}
+	var err error
+	this.repo, err = NewRepoService(this.Dir)
+	return err
+}
+
+// load the auth file and release the default pages if missing, before serving the wiki
+func (this *Wiki) prepare() {
+	authfile := this.configFile(this.Auth)
+	if _, err := os.Stat(authfile); len(this.Auth) > 0 && !os.IsNotExist(err) {
+		this.authenticator = auth.NewBasicAuthenticator("strapdown.ztx.io", auth.HtpasswdFileProvider(authfile)) // should we replace the url here?
+		log.Printf("use authentication file %s for %s", this.Auth, this.Prefix)
+	} else {
+		log.Printf("authentication file not exist, disable http authentication for %s", this.Prefix)
+	}
+
+	for name, asset := range map[string]string{".md": "_static/.md", "favicon.ico": "_static/fav.ico"} {
+		if _, err := os.Stat(this.file(name)); os.IsNotExist(err) {
+			// release the files
+			log.Printf("Release the default %s for %s", name, this.Prefix)
+			file, err := Asset(asset)
+			if err != nil {
+				log.Printf("[ WARN ] fail to load %s", asset)
+				continue
+			}
+			if err = ioutil.WriteFile(this.file(name), file, 0644); err != nil {
+				log.Printf("[ WARN ] cannot write default %s: %v", name, err)
+			}
+		}
+	}
+
+	// the path and search indexes are loaded, or rebuilt if stale, before serving any history or search
+	if repo, err := this.repo.Open(); err == nil {
+		if err = this.repo.index.Update(repo); err != nil {
+			log.Printf("[ WARN ] cannot update path index of %s: %v", this.Prefix, err)
+		}
+		if err = this.repo.search.Update(repo); err != nil {
+			log.Printf("[ WARN ] cannot update search index of %s: %v", this.Prefix, err)
+		}
+		this.repo.Release(repo)
+	}
+}
+
+func setWikis(all []*Wiki) {
+	wikis = all
+	sort.SliceStable(wikis, func(i, j int) bool {
+		return len(wikis[i].Prefix) > len(wikis[j].Prefix)
+	})
+}
+
+// the wiki serving the url path, and the path in that wiki
+// ok is false if the path is the prefix without the trailing slash, which should be redirected
+func findWiki(urlpath string) (wiki *Wiki, fp string, ok bool) {
+	for _, wiki := range wikis {
+		if strings.HasPrefix(urlpath, wiki.Prefix) {
+			return wiki, urlpath[len(wiki.Prefix):], true
+		}
+		if urlpath+"/" == wiki.Prefix {
+			return wiki, "", false
+		}
+	}
+	return mainWiki, strings.TrimPrefix(urlpath, "/"), true
+}
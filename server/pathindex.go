@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/libgit2/git2go"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the path index maps every path to the commits of HEAD changing it, so that history does not walk the whole repository
+// it is kept in .git as a log of commits, one json line per commit, parents before children
+// new commits are appended after every write, and the index is rebuilt when HEAD is no longer a descendant of its tip,
+// e.g. after a reset by sync
+
+const PATH_INDEX_FILE = "strapdown-pathindex"
+
+type pathChange struct {
+	Path    string
+	OldPath string `json:",omitempty"` // renamed from OldPath in this commit
+	Blob    string `json:",omitempty"` // empty when deleted
+}
+
+type indexedCommit struct {
+	Commit  string
+	Time    int64 // of the author, as shown in history
+	Changes []pathChange
+}
+
+type pathRef struct {
+	seq    int // position in commits
+	change int // position in the changes of the commit
+}
+
+type pathIndex struct {
+	sync.Mutex
+	loaded  bool
+	tip     string
+	commits []indexedCommit // parents before children
+	seqs    map[string]int
+	paths   map[string][]pathRef // in the order of commits
+}
+
+func (this *pathIndex) reset() {
+	this.tip = ""
+	this.commits = nil
+	this.seqs = make(map[string]int)
+	this.paths = make(map[string][]pathRef)
+}
+
+func (this *pathIndex) add(commit indexedCommit) {
+	seq := len(this.commits)
+	this.commits = append(this.commits, commit)
+	this.seqs[commit.Commit] = seq
+	for i, change := range commit.Changes {
+		this.paths[change.Path] = append(this.paths[change.Path], pathRef{seq: seq, change: i})
+	}
+	this.tip = commit.Commit
+}
+
+func (this *pathIndex) load(fp string) error {
+	this.reset()
+	file, err := os.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	for decoder.More() {
+		var commit indexedCommit
+		if err = decoder.Decode(&commit); err != nil {
+			// a broken index is rebuilt
+			this.reset()
+			return err
+		}
+		this.add(commit)
+	}
+	return nil
+}
+
+// bring the index up to HEAD, loaded from disk the first time
+func (this *pathIndex) Update(repo *git.Repository) error {
+	this.Lock()
+	defer this.Unlock()
+
+	fp := filepath.Join(repo.Path(), PATH_INDEX_FILE)
+	if !this.loaded {
+		this.loaded = true
+		if err := this.load(fp); err != nil && !os.IsNotExist(err) {
+			log.Printf("[ WARN ] cannot load path index %s: %v", fp, err)
+		}
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		// nothing committed yet
+		if len(this.commits) > 0 {
+			this.reset()
+			os.Remove(fp)
+		}
+		return nil
+	}
+	headId := head.Target()
+	head.Free()
+	if this.tip == headId.String() {
+		return nil
+	}
+
+	var tipId *git.Oid
+	if len(this.tip) > 0 {
+		tipId, _ = git.NewOid(this.tip)
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if tipId != nil {
+		if descendant, err := repo.DescendantOf(headId, tipId); err != nil || !descendant {
+			tipId = nil
+		}
+	}
+	if tipId == nil {
+		if len(this.commits) > 0 {
+			log.Printf("history of HEAD changed, rebuild path index")
+		}
+		this.reset()
+		flags |= os.O_TRUNC
+	}
+
+	revwalk, err := repo.Walk()
+	if err != nil {
+		return err
+	}
+	defer revwalk.Free()
+	if err = revwalk.Push(headId); err != nil {
+		return err
+	}
+	if tipId != nil {
+		if err = revwalk.Hide(tipId); err != nil {
+			return err
+		}
+	}
+	revwalk.Sorting(git.SortTopological | git.SortReverse)
+
+	// the index still works in memory if it cannot be saved
+	var writer *bufio.Writer
+	file, err := os.OpenFile(fp, flags, 0644)
+	if err != nil {
+		log.Printf("[ WARN ] cannot save path index %s: %v", fp, err)
+	} else {
+		defer file.Close()
+		writer = bufio.NewWriter(file)
+		defer writer.Flush()
+	}
+	encoder := json.NewEncoder(writer)
+
+	var walkErr error
+	count := 0
+	err = revwalk.Iterate(func(commit *git.Commit) bool {
+		defer commit.Free()
+		indexed, err := indexCommit(repo, commit)
+		if err != nil {
+			walkErr = err
+			return false
+		}
+		this.add(indexed)
+		if writer != nil {
+			if err = encoder.Encode(indexed); err != nil {
+				log.Printf("[ WARN ] cannot save path index %s: %v", fp, err)
+				writer = nil
+			}
+		}
+		count++
+		return true
+	})
+	if walkErr != nil {
+		err = walkErr
+	}
+	if err != nil {
+		// start over next time
+		this.reset()
+		if writer != nil {
+			writer.Reset(file)
+			file.Truncate(0)
+		}
+		return err
+	}
+	this.tip = headId.String()
+	if wikiConfig.verbose {
+		log.Printf("[ DEBUG ] %d commits added to path index", count)
+	}
+	return nil
+}
+
+// the paths changed by commit, merges only count the paths different from every parent
+func indexCommit(repo *git.Repository, commit *git.Commit) (indexedCommit, error) {
+	indexed := indexedCommit{Commit: commit.Id().String(), Time: commit.Author().When.Unix()}
+	tree, err := commit.Tree()
+	if err != nil {
+		return indexed, err
+	}
+	defer tree.Free()
+
+	n := commit.ParentCount()
+	if n <= 1 {
+		var parentTree *git.Tree
+		if n == 1 {
+			parent := commit.Parent(0)
+			parentTree, err = parent.Tree()
+			parent.Free()
+			if err != nil {
+				return indexed, err
+			}
+			defer parentTree.Free()
+		}
+		diff, err := repo.DiffTreeToTree(parentTree, tree, nil)
+		if err != nil {
+			return indexed, err
+		}
+		defer diff.Free()
+		// renames are followed by history, just like getRenameSource
+		opts, err := git.DefaultDiffFindOptions()
+		if err != nil {
+			return indexed, err
+		}
+		opts.Flags = git.DiffFindRenames
+		if err = diff.FindSimilar(&opts); err != nil {
+			return indexed, err
+		}
+		err = diff.ForEach(func(delta git.DiffDelta, _ float64) (git.DiffForEachHunkCallback, error) {
+			switch delta.Status {
+			case git.DeltaDeleted:
+				indexed.Changes = append(indexed.Changes, pathChange{Path: delta.OldFile.Path})
+			case git.DeltaRenamed:
+				indexed.Changes = append(indexed.Changes,
+					pathChange{Path: delta.OldFile.Path},
+					pathChange{Path: delta.NewFile.Path, OldPath: delta.OldFile.Path, Blob: delta.NewFile.Oid.String()})
+			default:
+				indexed.Changes = append(indexed.Changes, pathChange{Path: delta.NewFile.Path, Blob: delta.NewFile.Oid.String()})
+			}
+			return nil, nil
+		}, git.DiffDetailFiles)
+		return indexed, err
+	}
+
+	counts := make(map[string]uint)
+	for i := uint(0); i < n; i++ {
+		parent := commit.Parent(i)
+		parentTree, err := parent.Tree()
+		parent.Free()
+		if err != nil {
+			return indexed, err
+		}
+		diff, err := repo.DiffTreeToTree(parentTree, tree, nil)
+		parentTree.Free()
+		if err != nil {
+			return indexed, err
+		}
+		err = diff.ForEach(func(delta git.DiffDelta, _ float64) (git.DiffForEachHunkCallback, error) {
+			if delta.Status == git.DeltaDeleted {
+				counts[delta.OldFile.Path]++
+			} else {
+				counts[delta.NewFile.Path]++
+			}
+			return nil, nil
+		}, git.DiffDetailFiles)
+		diff.Free()
+		if err != nil {
+			return indexed, err
+		}
+	}
+	var changed []string
+	for fp, count := range counts {
+		if count == n {
+			changed = append(changed, fp)
+		}
+	}
+	sort.Strings(changed)
+	for _, fp := range changed {
+		change := pathChange{Path: fp}
+		if entry, err := tree.EntryByPath(fp); err == nil {
+			change.Blob = entry.Id.String()
+		}
+		indexed.Changes = append(indexed.Changes, change)
+	}
+	return indexed, nil
+}
+
+// feed the versions of fp on HEAD to collector, the latest first, renames are followed
+// false if the index is not available, then the repository should be walked instead
+func (this *pathIndex) History(repo *git.Repository, fp string, collector *historyCollector) bool {
+	if err := this.Update(repo); err != nil {
+		log.Printf("[ WARN ] cannot update path index: %v", err)
+		return false
+	}
+	this.Lock()
+	defer this.Unlock()
+
+	curfp := fp
+	bound := len(this.commits)
+	for len(curfp) > 0 {
+		refs := this.paths[curfp]
+		oldfp := ""
+		for i := len(refs) - 1; i >= 0 && len(oldfp) == 0; i-- {
+			ref := refs[i]
+			if ref.seq >= bound {
+				continue
+			}
+			indexed := this.commits[ref.seq]
+			change := indexed.Changes[ref.change]
+			if len(change.OldPath) > 0 {
+				// older versions are under the old name
+				oldfp = change.OldPath
+				bound = ref.seq
+			}
+			if len(change.Blob) == 0 || collector.skip(indexed.Commit) {
+				continue
+			}
+
+			oid, err := git.NewOid(indexed.Commit)
+			if err != nil {
+				return true
+			}
+			commit, err := repo.LookupCommit(oid)
+			if err != nil {
+				log.Printf("[ WARN ] commit %s of path index not found: %v", indexed.Commit, err)
+				return true
+			}
+			entry := newCommitEntry(commit)
+			email := commit.Author().Email
+			commit.Free()
+			entry.EntryId = change.Blob
+			if curfp != fp {
+				entry.OldPath = curfp
+			}
+			if !collector.add(entry, email) {
+				return true
+			}
+		}
+		curfp = oldfp
+	}
+	return true
+}
+
+// the time of the last change under each entry of dir as of version, for directory listings
+// false if version is not in the index
+func (this *pathIndex) LastChanges(repo *git.Repository, dir string, version string) (map[string]time.Time, bool) {
+	if err := this.Update(repo); err != nil {
+		log.Printf("[ WARN ] cannot update path index: %v", err)
+		return nil, false
+	}
+	this.Lock()
+	defer this.Unlock()
+
+	vseq, ok := this.seqs[version]
+	if !ok {
+		return nil, false
+	}
+	prefix := strings.Trim(dir, "/")
+	if len(prefix) > 0 {
+		prefix += "/"
+	}
+	changes := make(map[string]time.Time)
+	for fp, refs := range this.paths {
+		if !strings.HasPrefix(fp, prefix) {
+			continue
+		}
+		name := strings.TrimPrefix(fp, prefix)
+		if i := strings.IndexByte(name, '/'); i >= 0 {
+			name = name[:i]
+		}
+		for i := len(refs) - 1; i >= 0; i-- {
+			if refs[i].seq <= vseq {
+				when := time.Unix(this.commits[refs[i].seq].Time, 0)
+				if when.After(changes[name]) {
+					changes[name] = when
+				}
+				break
+			}
+		}
+	}
+	return changes, true
+}
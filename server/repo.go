@@ -0,0 +1,191 @@
+package main
+
+import (
+	"github.com/libgit2/git2go"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// the wiki repository is opened once and shared by all requests
+// reads borrow a handle from a small pool so that they run concurrently,
+// modifications of HEAD, index and working tree go through a single queue, one at a time
+
+const (
+	REPO_READERS   = 8  // idle read handles kept for reuse
+	REPO_QUEUE_LEN = 64 // pending writes, also the largest batch
+)
+
+type repoJob struct {
+	run  func(repo *git.Repository, index *git.Index) error
+	err  error
+	done chan error
+}
+
+type RepoService struct {
+	dir     string
+	writer  *git.Repository // only used by the queue
+	readers chan *git.Repository
+	jobs    chan *repoJob
+	index   pathIndex      // of HEAD, updated after every batch
+	search  searchIndex    // likewise
+	undo    []func() error // restores the working tree if the running job fails
+}
+
+func NewRepoService(dir string) (*RepoService, error) {
+	writer, err := git.OpenRepository(dir)
+	if err != nil {
+		return nil, err
+	}
+	this := &RepoService{
+		dir:     dir,
+		writer:  writer,
+		readers: make(chan *git.Repository, REPO_READERS),
+		jobs:    make(chan *repoJob, REPO_QUEUE_LEN),
+	}
+	go this.loop()
+	return this, nil
+}
+
+// borrow a handle for reading, it should be given back by Release
+func (this *RepoService) Open() (*git.Repository, error) {
+	select {
+	case repo := <-this.readers:
+		return repo, nil
+	default:
+		return git.OpenRepository(this.dir)
+	}
+}
+
+func (this *RepoService) Release(repo *git.Repository) {
+	select {
+	case this.readers <- repo:
+	default:
+		repo.Free()
+	}
+}
+
+// run f in the write queue and wait for it
+// f gets the repository index, which is written to disk after f returns
+func (this *RepoService) Write(f func(repo *git.Repository, index *git.Index) error) error {
+	job := &repoJob{run: f, done: make(chan error, 1)}
+	this.jobs <- job
+	return <-job.done
+}
+
+// write a file of the working tree in a write job, the old content is put back if the job fails
+func (this *RepoService) WriteFile(fp string, content []byte, perm os.FileMode) error {
+	old, err := ioutil.ReadFile(fp)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	existed := err == nil
+	if err = ioutil.WriteFile(fp, content, perm); err != nil {
+		return err
+	}
+	this.undo = append(this.undo, func() error {
+		if existed {
+			return ioutil.WriteFile(fp, old, perm)
+		}
+		return os.Remove(fp)
+	})
+	return nil
+}
+
+// rename a file of the working tree in a write job, it is renamed back if the job fails
+func (this *RepoService) Rename(from string, to string) error {
+	if err := os.Rename(from, to); err != nil {
+		return err
+	}
+	this.undo = append(this.undo, func() error {
+		return os.Rename(to, from)
+	})
+	return nil
+}
+
+func (this *RepoService) loop() {
+	for job := range this.jobs {
+		batch := []*repoJob{job}
+		// jobs queued while the last batch was running are handled together
+	collect:
+		for len(batch) < REPO_QUEUE_LEN {
+			select {
+			case job := <-this.jobs:
+				batch = append(batch, job)
+			default:
+				break collect
+			}
+		}
+		this.runBatch(batch)
+	}
+}
+
+// each job makes its own commits, but the index is loaded and written once for the whole batch
+func (this *RepoService) runBatch(batch []*repoJob) {
+	index, err := this.writer.Index()
+	if err != nil {
+		for _, job := range batch {
+			job.done <- err
+		}
+		return
+	}
+	defer index.Free()
+
+	for _, job := range batch {
+		this.undo = nil
+		job.err = job.run(this.writer, index)
+		if job.err != nil {
+			// drop whatever the failed job has staged or written
+			if err := resetIndex(this.writer, index); err != nil {
+				log.Printf("[ WARN ] cannot reset index: %v", err)
+			}
+			for i := len(this.undo) - 1; i >= 0; i-- {
+				if err := this.undo[i](); err != nil {
+					log.Printf("[ WARN ] cannot restore working tree: %v", err)
+				}
+			}
+		}
+	}
+	this.undo = nil
+	if wikiConfig.verbose && len(batch) > 1 {
+		log.Printf("[ DEBUG ] %d writes in one batch", len(batch))
+	}
+
+	// the commits have landed anyway, the index is written again by the next batch
+	if err := index.Write(); err != nil {
+		log.Printf("[ WARN ] cannot write index: %v", err)
+	}
+	// the history of new commits is ready before the writers return
+	if err := this.index.Update(this.writer); err != nil {
+		log.Printf("[ WARN ] cannot update path index: %v", err)
+	}
+	if err := this.search.Update(this.writer); err != nil {
+		log.Printf("[ WARN ] cannot update search index: %v", err)
+	}
+	for _, job := range batch {
+		job.done <- job.err
+	}
+}
+
+// make the index match the tree of HEAD
+func resetIndex(repo *git.Repository, index *git.Index) error {
+	head, err := repo.Head()
+	if err != nil {
+		// nothing committed yet
+		return index.Clear()
+	}
+	defer head.Free()
+
+	commit, err := repo.LookupCommit(head.Target())
+	if err != nil {
+		return err
+	}
+	defer commit.Free()
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+	defer tree.Free()
+	return index.ReadTree(tree)
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"github.com/libgit2/git2go"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// the search index is an inverted index of the pages on HEAD, kept in .git next to the path index
+// pages are added and removed by diffing the tree of the indexed commit with HEAD after every write,
+// so commits made by sync or pushed over http are picked up as well, and it is rebuilt from scratch if missing
+// results are ranked by BM25, terms in the title and headings count more than in the body
+//
+// words are split at anything but letters and digits, CJK text has no spaces so it is indexed as bigrams
+//
+// the file is saved a while after an update, not on every write, so a burst of commits is saved once,
+// only a rebuilt index is saved right away
+// if the server stops before that, the saved index is brought up to HEAD from its own tip at the next start
+
+const (
+	SEARCH_INDEX_FILE    = "strapdown-searchindex"
+	SEARCH_INDEX_VERSION = 1
+	SEARCH_RESULTS       = 20 // default number of results
+	SEARCH_SAVE_DELAY    = 10 * time.Second
+
+	SEARCH_TITLE_BOOST   = 3.0 // the file name and the first heading
+	SEARCH_HEADING_BOOST = 2.0
+	SEARCH_PREFIX_WEIGHT = 0.5 // words only starting with a term of the query
+	SEARCH_PREFIX_TERMS  = 32  // at most this many words for a prefix
+
+	BM25_K1 = 1.2
+	BM25_B  = 0.75
+)
+
+type searchDoc struct {
+	Path    string
+	Blob    string
+	Title   string
+	Length  int  // number of words
+	Deleted bool // postings are dropped at the next compaction
+}
+
+type searchPosting struct {
+	Doc  int     // position in docs
+	Freq float64 // term frequency, weighted by the field boosts
+}
+
+// the file format, written with gob
+type searchSnapshot struct {
+	Version int
+	Tip     string
+	Docs    []searchDoc
+	Terms   map[string][]searchPosting
+}
+
+type searchHit struct {
+	Path  string
+	Title string
+	Blob  string
+	Score float64
+}
+
+type searchIndex struct {
+	sync.Mutex
+	loaded  bool
+	tip     string
+	docs    []searchDoc
+	terms   map[string][]searchPosting
+	paths   map[string]int // live docs
+	live    int
+	length  int      // of all live docs
+	deleted int      // docs waiting for compaction
+	sorted  []string // terms in order for prefix search, nil if stale
+	fp      string
+	pending bool       // a save is scheduled
+	saving  sync.Mutex // saves are written one at a time, in order
+}
+
+func (this *searchIndex) reset() {
+	this.tip = ""
+	this.docs = nil
+	this.terms = make(map[string][]searchPosting)
+	this.paths = make(map[string]int)
+	this.live = 0
+	this.length = 0
+	this.deleted = 0
+	this.sorted = nil
+}
+
+func (this *searchIndex) load(fp string) error {
+	this.reset()
+	file, err := os.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var snapshot searchSnapshot
+	if err = gob.NewDecoder(bufio.NewReader(file)).Decode(&snapshot); err != nil {
+		// a broken index is rebuilt
+		return err
+	}
+	if snapshot.Version != SEARCH_INDEX_VERSION {
+		log.Printf("search index %s is of another version, rebuild it", fp)
+		return nil
+	}
+	this.tip = snapshot.Tip
+	this.docs = snapshot.Docs
+	if snapshot.Terms != nil {
+		this.terms = snapshot.Terms
+	}
+	for i, doc := range this.docs {
+		if doc.Deleted {
+			this.deleted++
+			continue
+		}
+		this.paths[doc.Path] = i
+		this.live++
+		this.length += doc.Length
+	}
+	return nil
+}
+
+// save the index after delay, updates until then are saved together
+func (this *searchIndex) scheduleSave(delay time.Duration) {
+	if this.pending {
+		return
+	}
+	this.pending = true
+	time.AfterFunc(delay, func() {
+		if err := this.save(); err != nil {
+			// the index still works in memory if it cannot be saved
+			log.Printf("[ WARN ] cannot save search index %s: %v", this.fp, err)
+		}
+	})
+}
+
+// searches only wait for the encoding, the file is written without holding the lock
+// written to a temporary file first, a crash never leaves a broken index behind
+func (this *searchIndex) save() error {
+	this.saving.Lock()
+	defer this.saving.Unlock()
+
+	this.Lock()
+	this.pending = false
+	fp := this.fp
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(searchSnapshot{
+		Version: SEARCH_INDEX_VERSION,
+		Tip:     this.tip,
+		Docs:    this.docs,
+		Terms:   this.terms,
+	})
+	this.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := fp + ".tmp"
+	if err = ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, fp)
+}
+
+// whether the page at fp is searched
+func isSearchable(fp string) bool {
+	return strings.HasSuffix(fp, ".md") && !isReservedPath(fp)
+}
+
+func (this *searchIndex) add(fp string, blob string, content []byte) {
+	title, freqs, length := analyzePage(fp, string(content))
+	seq := len(this.docs)
+	this.docs = append(this.docs, searchDoc{Path: fp, Blob: blob, Title: title, Length: length})
+	for term, freq := range freqs {
+		if _, ok := this.terms[term]; !ok {
+			this.sorted = nil
+		}
+		this.terms[term] = append(this.terms[term], searchPosting{Doc: seq, Freq: freq})
+	}
+	this.paths[fp] = seq
+	this.live++
+	this.length += length
+}
+
+func (this *searchIndex) remove(fp string) {
+	seq, ok := this.paths[fp]
+	if !ok {
+		return
+	}
+	this.docs[seq].Deleted = true
+	delete(this.paths, fp)
+	this.live--
+	this.length -= this.docs[seq].Length
+	this.deleted++
+}
+
+// drop the postings of deleted docs once they are the majority
+func (this *searchIndex) compact() {
+	if this.deleted <= this.live {
+		return
+	}
+	seqs := make([]int, len(this.docs))
+	var docs []searchDoc
+	for i, doc := range this.docs {
+		seqs[i] = -1
+		if !doc.Deleted {
+			seqs[i] = len(docs)
+			this.paths[doc.Path] = len(docs)
+			docs = append(docs, doc)
+		}
+	}
+	for term, postings := range this.terms {
+		kept := postings[:0]
+		for _, posting := range postings {
+			if seq := seqs[posting.Doc]; seq >= 0 {
+				kept = append(kept, searchPosting{Doc: seq, Freq: posting.Freq})
+			}
+		}
+		if len(kept) == 0 {
+			delete(this.terms, term)
+		} else {
+			this.terms[term] = kept
+		}
+	}
+	this.docs = docs
+	this.deleted = 0
+	this.sorted = nil
+}
+
+// bring the index up to HEAD, loaded from disk the first time
+func (this *searchIndex) Update(repo *git.Repository) error {
+	this.Lock()
+	defer this.Unlock()
+
+	if !this.loaded {
+		this.loaded = true
+		this.fp = filepath.Join(repo.Path(), SEARCH_INDEX_FILE)
+		if err := this.load(this.fp); err != nil && !os.IsNotExist(err) {
+			log.Printf("[ WARN ] cannot load search index %s: %v", this.fp, err)
+		}
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		// nothing committed yet
+		if len(this.docs) > 0 {
+			this.reset()
+			os.Remove(this.fp)
+		}
+		return nil
+	}
+	headId := head.Target()
+	head.Free()
+	if this.tip == headId.String() {
+		return nil
+	}
+
+	commit, err := repo.LookupCommit(headId)
+	if err != nil {
+		return err
+	}
+	defer commit.Free()
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+	defer tree.Free()
+
+	// any indexed commit works as the base of the diff, it does not have to be an ancestor of HEAD
+	var tipTree *git.Tree
+	if tipId, err := git.NewOid(this.tip); err == nil {
+		if tipCommit, err := repo.LookupCommit(tipId); err == nil {
+			tipTree, err = tipCommit.Tree()
+			tipCommit.Free()
+			if err == nil {
+				defer tipTree.Free()
+			}
+		}
+	}
+	rebuild := tipTree == nil
+	if rebuild {
+		if len(this.docs) > 0 {
+			log.Printf("commit %s of search index not found, rebuild it", this.tip)
+		}
+		this.reset()
+	}
+
+	diff, err := repo.DiffTreeToTree(tipTree, tree, nil)
+	if err != nil {
+		return err
+	}
+	defer diff.Free()
+	var deltas []git.DiffDelta
+	err = diff.ForEach(func(delta git.DiffDelta, _ float64) (git.DiffForEachHunkCallback, error) {
+		deltas = append(deltas, delta)
+		return nil, nil
+	}, git.DiffDetailFiles)
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	for _, delta := range deltas {
+		if delta.Status != git.DeltaAdded {
+			this.remove(delta.OldFile.Path)
+		}
+		if delta.Status == git.DeltaDeleted || !isSearchable(delta.NewFile.Path) {
+			continue
+		}
+		blob, err := repo.LookupBlob(delta.NewFile.Oid)
+		if err != nil {
+			// start over next time
+			this.reset()
+			return err
+		}
+		this.add(delta.NewFile.Path, delta.NewFile.Oid.String(), blob.Contents())
+		blob.Free()
+		count++
+	}
+	this.tip = headId.String()
+	this.compact()
+	if rebuild {
+		this.scheduleSave(0)
+	} else {
+		this.scheduleSave(SEARCH_SAVE_DELAY)
+	}
+	if wikiConfig.verbose {
+		log.Printf("[ DEBUG ] %d pages added to search index", count)
+	}
+	return nil
+}
+
+// the pages matching query, the most relevant first
+func (this *searchIndex) Search(repo *git.Repository, query string, limit int) []searchHit {
+	if err := this.Update(repo); err != nil {
+		log.Printf("[ WARN ] cannot update search index: %v", err)
+	}
+	this.Lock()
+	defer this.Unlock()
+
+	if this.live == 0 {
+		return nil
+	}
+	if this.sorted == nil {
+		this.sorted = make([]string, 0, len(this.terms))
+		for term := range this.terms {
+			this.sorted = append(this.sorted, term)
+		}
+		sort.Strings(this.sorted)
+	}
+
+	avglength := float64(this.length) / float64(this.live)
+	if avglength == 0 {
+		avglength = 1
+	}
+	scores := make(map[int]float64)
+	for _, word := range searchTerms(query) {
+		weights := map[string]float64{word: 1}
+		// unfinished words of the query, e.g. strap for strapdown
+		for i := sort.SearchStrings(this.sorted, word); i < len(this.sorted) && len(weights) <= SEARCH_PREFIX_TERMS; i++ {
+			if !strings.HasPrefix(this.sorted[i], word) {
+				break
+			}
+			if this.sorted[i] != word {
+				weights[this.sorted[i]] = SEARCH_PREFIX_WEIGHT
+			}
+		}
+		for term, weight := range weights {
+			postings := this.terms[term]
+			n := 0
+			for _, posting := range postings {
+				if !this.docs[posting.Doc].Deleted {
+					n++
+				}
+			}
+			if n == 0 {
+				continue
+			}
+			idf := math.Log(1 + (float64(this.live)-float64(n)+0.5)/(float64(n)+0.5))
+			for _, posting := range postings {
+				doc := &this.docs[posting.Doc]
+				if doc.Deleted {
+					continue
+				}
+				norm := BM25_K1 * (1 - BM25_B + BM25_B*float64(doc.Length)/avglength)
+				scores[posting.Doc] += weight * idf * posting.Freq * (BM25_K1 + 1) / (posting.Freq + norm)
+			}
+		}
+	}
+
+	hits := make([]searchHit, 0, len(scores))
+	for seq, score := range scores {
+		doc := this.docs[seq]
+		hits = append(hits, searchHit{Path: doc.Path, Title: doc.Title, Blob: doc.Blob, Score: score})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].Path < hits[j].Path
+	})
+	if limit > 0 && len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return hits
+}
+
+// the title, the weighted frequency of every term and the number of words of a page
+func analyzePage(fp string, content string) (title string, freqs map[string]float64, length int) {
+	freqs = make(map[string]float64)
+	count := func(boost float64) func(string) {
+		return func(term string) {
+			freqs[term] += boost
+			length++
+		}
+	}
+	name := strings.TrimSuffix(path.Base(fp), ".md")
+	splitTerms(name, count(SEARCH_TITLE_BOOST))
+
+	fenced := false
+	for _, line := range strings.Split(content, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			fenced = !fenced
+		}
+		if fenced || !strings.HasPrefix(trimmed, "#") {
+			splitTerms(line, count(1))
+			continue
+		}
+		heading := strings.TrimSpace(strings.TrimLeft(trimmed, "#"))
+		if len(title) == 0 && len(heading) > 0 {
+			title = heading
+			splitTerms(heading, count(SEARCH_TITLE_BOOST))
+		} else {
+			splitTerms(heading, count(SEARCH_HEADING_BOOST))
+		}
+	}
+	if len(title) == 0 {
+		title = name
+	}
+	return title, freqs, length
+}
+
+// a piece of content around the first term found, for the result list
+func searchSnippet(content string, terms []string) string {
+	lower := strings.ToLower(content)
+	pos := -1
+	for _, term := range terms {
+		if i := UnicodeIndex(lower, term); i >= 0 && (pos < 0 || i < pos) {
+			pos = i
+		}
+	}
+	if pos < 0 {
+		pos = 0
+	}
+	return Substr(content, pos-15, 30)
+}
+
+// the distinct terms of a query
+func searchTerms(query string) []string {
+	var terms []string
+	seen := make(map[string]bool)
+	splitTerms(query, func(term string) {
+		if !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	})
+	return terms
+}
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// lowercase words of letters and digits, and bigrams of CJK text, which has no spaces between words
+func splitTerms(text string, emit func(string)) {
+	var word []rune
+	var cjk []rune
+	flushWord := func() {
+		if len(word) > 0 {
+			emit(string(word))
+			word = word[:0]
+		}
+	}
+	flushCJK := func() {
+		if len(cjk) == 1 {
+			emit(string(cjk))
+		}
+		for i := 0; i+1 < len(cjk); i++ {
+			emit(string(cjk[i : i+2]))
+		}
+		cjk = cjk[:0]
+	}
+	for _, r := range text {
+		switch {
+		case isCJK(r):
+			flushWord()
+			cjk = append(cjk, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			flushCJK()
+			word = append(word, unicode.ToLower(r))
+		default:
+			flushWord()
+			flushCJK()
+		}
+	}
+	flushWord()
+	flushCJK()
+}
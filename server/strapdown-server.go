@@ -9,7 +9,6 @@ import (
 	"errors"
 	"flag"
 	"fmt"
-	auth "github.com/abbot/go-http-auth"
 	"github.com/libgit2/git2go"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
@@ -20,6 +19,7 @@ import (
 	"log"
 	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
@@ -74,12 +74,112 @@ type CommitEntry struct {
 	Timestamp time.Time
 	Author    string
 	Message   string
+	OldPath   string // set when the file had another name in this commit
+	Minor     bool   // a minor edit, marked by MINOR_TRAILER
 }
 
 func (this *CommitEntry) ShortHash() string {
 	return this.Id[:11]
 }
 
+// link to view this version, follows the old name of a renamed file
+func (this *CommitEntry) Link() string {
+	if len(this.OldPath) == 0 {
+		return "?version=" + this.Id
+	}
+	u := url.URL{Path: "/" + strings.TrimSuffix(this.OldPath, ".md")}
+	return u.String() + "?version=" + this.Id
+}
+
+type BranchEntry struct {
+	Name  string
+	Tip   CommitEntry
+	Files []string // changed since forked from the current branch
+}
+
+// link to a changed file on the branch
+func (this *BranchEntry) Link(file string) string {
+	u := url.URL{Path: "/" + strings.TrimSuffix(file, ".md")}
+	return u.String() + "?branch=" + url.QueryEscape(this.Name)
+}
+
+// a commit of the recent changes, with the files it changed
+type ChangeEntry struct {
+	CommitEntry
+	Files []string
+}
+
+// link to a changed file at this commit
+func (this *ChangeEntry) FileLink(file string) string {
+	u := url.URL{Path: "/" + strings.TrimSuffix(file, ".md")}
+	return u.String() + "?version=" + this.Id
+}
+
+// a file changed by a single commit, with its diff
+type FileChange struct {
+	Commit  string
+	Path    string
+	OldPath string // set when the file was renamed
+	Status  string // added, deleted, modified or renamed
+	Added   int
+	Removed int
+	Binary  bool
+	Diff    template.HTML
+}
+
+// the file as of the commit, or just before it if deleted
+func (this *FileChange) Link() string {
+	u := url.URL{Path: "/" + strings.TrimSuffix(this.Path, ".md")}
+	if this.Status == "deleted" {
+		return u.String() + "?version=" + this.Commit + "~1"
+	}
+	return u.String() + "?version=" + this.Commit
+}
+
+// a page removed from the working tree, but still in the history
+type DeletedEntry struct {
+	CommitEntry // the commit which deleted the page
+	Path        string
+	LastVersion string // the last commit with the page
+}
+
+// the page as it was before deleted
+func (this *DeletedEntry) Link() string {
+	u := url.URL{Path: "/" + strings.TrimSuffix(this.Path, ".md")}
+	return u.String() + "?version=" + this.LastVersion
+}
+
+// the url of the .md file itself, for history and restore, the page url may be taken as a directory
+func (this *DeletedEntry) FileLink() string {
+	u := url.URL{Path: "/" + this.Path}
+	return u.String()
+}
+
+// a snapshot, i.e. a git tag of the wiki
+type TagEntry struct {
+	Id        string // the tagged commit
+	Name      string
+	Title     string
+	Tagger    string
+	Timestamp time.Time
+}
+
+func (this *TagEntry) ShortHash() string {
+	return this.Id[:11]
+}
+
+// browse the wiki as of the snapshot
+func (this *TagEntry) Link() string {
+	return "/?version=" + url.QueryEscape(this.Name)
+}
+
+type BlameLine struct {
+	CommitEntry
+	Line    int
+	Content string
+	First   bool // first line of a blame hunk
+}
+
 type Config struct {
 	addr           string
 	init           bool
@@ -97,6 +197,16 @@ type Config struct {
 	extract        bool
 	prefix         string
 	googleauth     string
+	remote         string
+	syncinterval   time.Duration
+	syncpolicy     string
+	users          string
+	authorip       bool
+	export         string
+	exportversion  string
+	importsrc      string
+	importformat   string
+	mounts         string
 }
 
 type RequestContext struct {
@@ -107,10 +217,28 @@ type RequestContext struct {
 	Content       template.HTML
 	DirEntries    []DirEntry
 	CommitEntries []CommitEntry
+	BlameLines    []BlameLine
+	Branches      []BranchEntry
+	Snapshots     []TagEntry
+	Changes       []ChangeEntry
+	Commit        *CommitEntry // the commit of ?commit=
+	FileChanges   []FileChange
+	DeletedPages  []DeletedEntry
+	Author        string // author filter of recent changes
+	HideMinor     bool   // minor edits are hidden from history and recent changes
+	Since         string // date filters of history
+	Until         string
+	After         string // the cursor of history, only versions older than this commit are listed
+	NextLink      string // the next page of history
 	Version       string
+	Branch        string // draft branch, empty for the current branch
 	Versions      []string
+	DiffMode      string
+	Export        bool   // rendered for the static site of -export, without the links to the server
+	Prefix        string // where the wiki is mounted, empty for the default wiki, absolute links start with it
 	Host          string //deleteme
 
+	wiki        *Wiki
 	path        string
 	res         *http.ResponseWriter
 	req         *http.Request
@@ -130,11 +258,11 @@ type CustomOption struct {
 	Toc           string
 	HeadingNumber string
 	Host          string
+	Redirect      string `json:",omitempty"` // left behind when the page is moved
 }
 
 var wikiConfig Config // the global config file
 var templates map[string]*template.Template
-var authenticator *auth.BasicAuth
 
 var SERVER_VERSION string
 
@@ -156,6 +284,16 @@ func parseConfig() {
 	flag.BoolVar(&wikiConfig.extract, "extract", false, "Extract assets to current working directory")
 	flag.StringVar(&wikiConfig.prefix, "prefix", "", "Use your own static files. Unless you know what you are doing, don't use this option with -host.")
 	flag.StringVar(&wikiConfig.googleauth, "googleauth", "", "Use Google Oauth 2 for authentication to get permission to edit contents")
+	flag.StringVar(&wikiConfig.remote, "remote", "", "Git remote `name or url` to sync the wiki with, every commit is pushed to it")
+	flag.DurationVar(&wikiConfig.syncinterval, "sync_interval", 5*time.Minute, "interval to pull changes from the remote, 0 to disable")
+	flag.StringVar(&wikiConfig.syncpolicy, "sync_policy", SYNC_POLICY_MERGE, "what to do when wiki and remote history diverge, merge or refuse")
+	flag.StringVar(&wikiConfig.users, "users", ".users", "User directory mapping logins to the names and emails of commit authors, one `login: Name <email>` per line")
+	flag.BoolVar(&wikiConfig.authorip, "author_ip", true, "append the IP address of the client to the commit author name")
+	flag.StringVar(&wikiConfig.export, "export", "", "Export the wiki as a static html site to `dir`, then exit")
+	flag.StringVar(&wikiConfig.exportversion, "export_version", "", "the version to export, HEAD by default")
+	flag.StringVar(&wikiConfig.importsrc, "import", "", "Import every revision of a MediaWiki xml dump or a DokuWiki data directory at `path`, then exit")
+	flag.StringVar(&wikiConfig.importformat, "import_format", "", "mediawiki or dokuwiki, detected from the path by default")
+	flag.StringVar(&wikiConfig.mounts, "mounts", "", "Json `file` listing more wikis to mount under url prefixes, each with its own git repository")
 	flag.Parse()
 }
 
@@ -195,19 +333,68 @@ func SafeOpen(base string, name string) (*os.File, error) {
 	return f, nil
 }
 
-func getHeadVersion() string {
-	repo, err := git.OpenRepository(".")
+// check if the path is git/auth related, return the reason if access should be forbidden
+func (this *Wiki) forbiddenPath(fp string) string {
+	lfp := strings.ToLower(fp)
+	if strings.HasPrefix(lfp, ".git/") || lfp == ".git" || lfp == ".gitignore" || lfp == ".gitmodules" {
+		return "access of .git related files/directory not allowed"
+	}
+	if len(this.Auth) > 0 && fp == this.Auth {
+		return "access of password file not allowed"
+	}
+	if len(wikiConfig.googleauth) > 0 && fp == wikiConfig.googleauth {
+		return "access of authentication file not allowed"
+	}
+	if len(this.Users) > 0 && fp == this.Users {
+		return "access of user directory not allowed"
+	}
+	return ""
+}
+
+// _static/ folder and favicon.ico are served by the server itself, they should not be modified
+func isReservedPath(fp string) bool {
+	return strings.HasPrefix(fp, "_static") || strings.HasSuffix(fp, "favicon.ico")
+}
+
+func (this *Wiki) getHeadVersion() string {
+	repo, err := this.repo.Open()
 	if err != nil {
 		return ""
 	}
 	head, err := repo.Head()
-	repo.Free() // no matter err is or isnot nil, free repo
+	this.repo.Release(repo) // no matter err is or isnot nil, release repo
 	if err != nil {
 		return ""
 	}
 	return head.Target().String()
 }
 
+// the tip of a local branch, empty if the branch does not exist
+func (this *Wiki) getBranchVersion(branch string) string {
+	repo, err := this.repo.Open()
+	if err != nil {
+		return ""
+	}
+	defer this.repo.Release(repo)
+	ref, err := repo.References.Lookup("refs/heads/" + branch)
+	if err != nil {
+		return ""
+	}
+	defer ref.Free()
+	return ref.Target().String()
+}
+
+// whether branch is the one HEAD points to, i.e. the published pages
+func (this *Wiki) isHeadBranch(branch string) bool {
+	repo, err := this.repo.Open()
+	if err != nil {
+		return false
+	}
+	defer this.repo.Release(repo)
+	current, err := headBranch(repo)
+	return err == nil && current == "refs/heads/"+branch
+}
+
 func bootstrap() {
 
 	mime.AddExtensionType(".md", "text/markdown")
@@ -219,6 +406,26 @@ func bootstrap() {
 		SERVER_VERSION = strings.TrimSpace(string(v))
 	}
 
+	if len(wikiConfig.export) > 0 {
+		// relative to where the server is started, not the wiki root
+		wikiConfig.export, err = filepath.Abs(wikiConfig.export)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(wikiConfig.importsrc) > 0 {
+		wikiConfig.importsrc, err = filepath.Abs(wikiConfig.importsrc)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(wikiConfig.mounts) > 0 {
+		wikiConfig.mounts, err = filepath.Abs(wikiConfig.mounts)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	if len(wikiConfig.root) > 0 {
 		// we should chdir to the root
 		err := os.Chdir(wikiConfig.root)
@@ -229,26 +436,12 @@ func bootstrap() {
 		log.Printf("chdir to the '%s'", wikiConfig.root)
 	}
 
-	if wikiConfig.init {
-		if repo, err := git.OpenRepository("."); err != nil {
-			_, err := git.InitRepository(".", false)
-			if err != nil {
-				log.Fatal(err)
-				os.Exit(1)
-			}
-			log.Printf("git init finished at .")
-		} else {
-			log.Printf("git repository already found, skip git init")
-			repo.Free()
-		}
-	}
-
 	if wikiConfig.version {
 		fmt.Printf("Strapdown Wiki Server - v%s\n", SERVER_VERSION)
 		os.Exit(0)
 	}
 
-	pages := []string{"view", "listdir", "history", "diff", "edit", "upload"}
+	pages := []string{"view", "listdir", "history", "diff", "edit", "upload", "delete", "blame", "branches", "snapshots", "changes", "diffrendered", "commit", "deleted"}
 	templates = make(map[string]*template.Template)
 
 	if len(wikiConfig.prefix) > 0 {
@@ -326,29 +519,8 @@ func (this *RequestContext) parseIp() {
 type SearchResult struct {
 	Match string
 	Path  string
-}
-
-//目录遍历文件
-func WalkDir(dirPath, suffix string) (files []string, err error) {
-	suffix = strings.ToUpper(suffix) //忽略后缀匹配的大小写
-
-	err = filepath.Walk(dirPath, func(filename string, fi os.FileInfo, err error) error { //遍历目录
-		if err != nil {
-			return err
-		}
-
-		if fi.IsDir() { // 忽略目录
-			return nil
-		}
-
-		if strings.HasSuffix(strings.ToUpper(fi.Name()), suffix) {
-			files = append(files, filename)
-		}
-
-		return nil
-	})
-
-	return files, err
+	Title string
+	Score float64
 }
 
 //字符串截取
@@ -379,35 +551,6 @@ func UnicodeIndex(str, substr string) int {
 	return result
 }
 
-//字符串匹配
-func searchStr(files []string, key string, suffix string, prefix string) (searchs []byte, err error) {
-	var jsondata []SearchResult
-	for i := 0; i < len(files); i++ {
-		f, err := os.OpenFile(files[i], os.O_RDONLY, 0444)
-		if err != nil {
-			return searchs, err
-		}
-		con, _ := ioutil.ReadAll(f)
-		str := string(con[:])
-		f.Close()
-		if strings.Contains(strings.ToLower(str), strings.ToLower(key)) {
-			pos := UnicodeIndex(strings.ToLower(str), strings.ToLower(key))
-			t := Substr(str, pos-15, 30)
-			searchfile := strings.TrimSuffix(files[i], suffix)
-			searchfile = strings.TrimPrefix(searchfile, prefix)
-			searchfile = "/" + searchfile
-			res := SearchResult{t, searchfile}
-			jsondata = append(jsondata, res)
-		}
-	}
-	b, err := json.Marshal(jsondata)
-	if err != nil {
-		return searchs, err
-	}
-	searchs = b
-	return searchs, err
-}
-
 // this handleFunc parse request and parameters, then dispatch the action to action.go
 func handleFunc(w http.ResponseWriter, r *http.Request) {
 	var err error
@@ -417,16 +560,20 @@ func handleFunc(w http.ResponseWriter, r *http.Request) {
 	ctx.res = &w
 	// init to 200 OK, if no error happens, then 200 will be printed by log
 	ctx.statusCode = http.StatusOK
-	ctx.Title = wikiConfig.title
-	ctx.Theme = wikiConfig.theme
-	ctx.Toc = wikiConfig.toc
-	ctx.HeadingNumber = wikiConfig.heading_number
+	// the wiki mounted at the longest prefix of the url serves the request
+	wiki, fp, mounted := findWiki(r.URL.Path)
+	ctx.wiki = wiki
+	ctx.Prefix = strings.TrimSuffix(wiki.Prefix, "/")
+	ctx.Title = wiki.Title
+	ctx.Theme = wiki.Theme
+	ctx.Toc = wiki.Toc
+	ctx.HeadingNumber = wiki.HeadingNumber
 	ctx.Host = wikiConfig.host
 
 	// check Google OAuth authentication state, set user profile if already logged in
 	ctx.gauthStatus = false
 	ctx.gusername = "anonymous"
-	ctx.gmailaddr = "strapdown@gmail.com"
+	ctx.gmailaddr = DEFAULT_AUTHOR_EMAIL
 	ctx.signature = ""
 	gusr_match := false
 	gemail_match := false
@@ -462,31 +609,36 @@ func handleFunc(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("X-Powered-By", "Strapdown Server (v"+SERVER_VERSION+")")
 
 	defer func() {
+		login, _ := ctx.login()
 		if !wikiConfig.verbose {
-			log.Printf("[ %s ] - %d %s by %s", r.Method, ctx.statusCode, r.URL.String(), ctx.gusername)
+			log.Printf("[ %s ] - %d %s by %s", r.Method, ctx.statusCode, r.URL.String(), login)
 		} else {
-			log.Printf("[ %s ] - %d %s (%s,%s) by %s", r.Method, ctx.statusCode, r.URL.String(), ctx.path, w.Header().Get("Content-Type"), ctx.gusername)
+			log.Printf("[ %s ] - %d %s (%s,%s) by %s", r.Method, ctx.statusCode, r.URL.String(), ctx.path, w.Header().Get("Content-Type"), login)
 		}
 	}()
 
 	// check auth first
-	if authenticator != nil { // check http auth
-		if ctx.username = authenticator.CheckAuth(r); ctx.username == "" {
+	if wiki.authenticator != nil { // check http auth
+		if ctx.username = wiki.authenticator.CheckAuth(r); ctx.username == "" {
 			ctx.statusCode = http.StatusUnauthorized // we need to setup statuscode every return to enable defered log to work
-			authenticator.RequireAuth(w, r)
+			wiki.authenticator.RequireAuth(w, r)
 			return
 		}
 	}
+	if !mounted {
+		ctx.statusCode = http.StatusMovedPermanently
+		http.Redirect(w, r, wiki.Prefix, ctx.statusCode)
+		return
+	}
 
 	// parse info from parameter first
 	ctx.parseIp()
 
 	var param_version string = ""
 
-	fp := r.URL.Path[1:]
 	fpmd := fp + ".md"
-	fpstat, fperr := os.Stat(fp)
-	fpmdstat, fpmderr := os.Stat(fpmd)
+	fpstat, fperr := os.Stat(wiki.file(fp))
+	fpmdstat, fpmderr := os.Stat(wiki.file(fpmd))
 
 	// consider the situation that, the xx.md file does not exist, but does exist in some history version
 	// the following `if` will fail, but luckily, we can still use xx.md?history to view the history
@@ -497,22 +649,22 @@ func handleFunc(w http.ResponseWriter, r *http.Request) {
 		ctx.path = fp
 	}
 
-	// forbidden any access of git related object
-	if strings.HasPrefix(strings.ToLower(fp), ".git/") || strings.ToLower(fp) == ".git" || strings.ToLower(fp) == ".gitignore" || strings.ToLower(fp) == ".gitmodules" {
-		ctx.statusCode = http.StatusForbidden
-		http.Error(w, "access of .git related files/directory not allowed", ctx.statusCode)
-		return
-	}
-	// forbidden any access of auth related object
-	if len(wikiConfig.auth) > 0 && fp == wikiConfig.auth {
-		ctx.statusCode = http.StatusForbidden
-		http.Error(w, "access of password file not allowed", ctx.statusCode)
+	// git smart http protocol, the .git protection below is for raw file access
+	if service, advertise := gitHTTPService(r, fp); len(service) > 0 {
+		err = ctx.GitHTTP(service, advertise)
+		if err != nil {
+			if ctx.statusCode == http.StatusOK {
+				ctx.statusCode = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), ctx.statusCode)
+		}
 		return
 	}
-	// forbidden any access of google oauth credential file
-	if len(wikiConfig.googleauth) > 0 && fp == wikiConfig.googleauth {
+
+	// forbidden any access of git/auth related object
+	if msg := wiki.forbiddenPath(fp); len(msg) > 0 {
 		ctx.statusCode = http.StatusForbidden
-		http.Error(w, "access of authentication file not allowed", ctx.statusCode)
+		http.Error(w, msg, ctx.statusCode)
 		return
 	}
 
@@ -539,7 +691,7 @@ func handleFunc(w http.ResponseWriter, r *http.Request) {
 			// assets prefered
 			asset, err = Asset(fp)
 			if err != nil && fperr == nil && !fpstat.IsDir() {
-				asset, err = ioutil.ReadFile(fp)
+				asset, err = ioutil.ReadFile(wiki.file(fp))
 			}
 		} else {
 			var f *os.File
@@ -579,13 +731,24 @@ func handleFunc(w http.ResponseWriter, r *http.Request) {
 	diff_ary, dodiff := q["diff"]
 	_, dooption := q["option"]
 	_, dodelete := q["delete"]
+	move_ary, domove := q["move"]
+	revert_ary, dorevert := q["revert"]
+	_, doblame := q["blame"]
+	merge_ary, domerge := q["merge"]
+	_, dobranches := q["branches"]
+	_, dosnapshots := q["snapshots"]
+	changes_ary, dochanges := q["changes"]
+	commit_ary, docommit := q["commit"]
+	archive_ary, doarchive := q["archive"]
+	_, dodeleted := q["deleted"]
+	restore_ary, dorestore := q["restore"]
 	//添加
 	_, dosearch := q["search"]
 
 	edit_ary, doedit := q["edit"]
 	version_ary, doversion := q["version"]
 
-	_, doupload := q["upload"]
+	upload_ary, doupload := q["upload"]
 
 	// if unlogged-in user's request is not "GET", redirect to google authenticaton page
 	// check if encryption result of user profile is valid, if invalid go to authentication page
@@ -605,16 +768,46 @@ func handleFunc(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// branch is not a standalone action either, reads and writes go to the draft branch instead of HEAD
+	ctx.Branch = q.Get("branch")
+	if len(ctx.Branch) > 0 {
+		if !git.ReferenceIsValidName("refs/heads/" + ctx.Branch) {
+			ctx.statusCode = http.StatusBadRequest
+			http.Error(w, "invalid branch name "+ctx.Branch, ctx.statusCode)
+			return
+		}
+		if wiki.isHeadBranch(ctx.Branch) {
+			ctx.Branch = ""
+		}
+	}
+
 	// version is not a standalone action
 	// it can be bound to edit or view actions, but history, diff, option just ignore version param
 	// so we parse versions first
-	ctx.Version = getHeadVersion()
+	ctx.Version = wiki.getHeadVersion()
+	if len(ctx.Branch) > 0 {
+		// a new draft branch starts from HEAD
+		if tip := wiki.getBranchVersion(ctx.Branch); len(tip) > 0 {
+			ctx.Version = tip
+			param_version = tip
+		}
+	}
 	if doversion {
 		if len(version_ary) > 0 && len(version_ary[0]) > 0 {
 			// note that
 			// this.Version is for View/Edit template
-			// param_version is the param user requested
-			param_version = version_ary[0]
+			// param_version is the param user requested, resolved to the full sha
+			param_version, err = wiki.resolveVersion(version_ary[0])
+			if err != nil {
+				ctx.statusCode = http.StatusBadRequest
+				http.Error(w, err.Error(), ctx.statusCode)
+				return
+			}
+			if len(param_version) == 0 {
+				ctx.statusCode = http.StatusNotFound
+				http.Error(w, "version "+version_ary[0]+" not found", ctx.statusCode)
+				return
+			}
 			ctx.Version = param_version
 		} else {
 			// default to latest
@@ -622,32 +815,30 @@ func handleFunc(w http.ResponseWriter, r *http.Request) {
 			param_version = ""
 		}
 	}
+	if len(ctx.Branch) > 0 && ctx.path == fp {
+		// the page may only exist on the draft branch, e.g. for history and diff
+		if content, _ := wiki.getFileOfVersion(fpmd, ctx.Version); content != nil {
+			ctx.path = fpmd
+		}
+	}
 	//添加
 	if dosearch {
 		key := q["search"][0]
 		if key == "" {
 			return
 		}
-		var files []string
-		var path string
-		path = "."
-		suffix := ".md" //查找文件类型，注意一定要有.
-		files, err = WalkDir(path, suffix)
-		if err != nil {
-			ctx.statusCode = http.StatusBadRequest
-			http.Error(w, err.Error(), ctx.statusCode)
-			return
+		limit := SEARCH_RESULTS
+		if n, err := strconv.Atoi(q.Get("limit")); err == nil && n > 0 {
+			limit = n
 		}
-		var searchs []byte
-		searchs, err = searchStr(files, key, suffix, path)
+		err = ctx.Search(key, limit)
 		if err != nil {
-			ctx.statusCode = http.StatusBadRequest
+			if ctx.statusCode == http.StatusOK {
+				ctx.statusCode = http.StatusBadRequest
+			}
 			http.Error(w, err.Error(), ctx.statusCode)
-			return
 		}
-		w.Write(searchs)
 		return
-
 	}
 
 	if dohistory {
@@ -664,9 +855,205 @@ func handleFunc(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
-		err = ctx.History(histsize)
+		_, hide_minor := q["hideminor"]
+		filter := historyFilter{Author: q.Get("author"), HideMinor: hide_minor}
+		if after := q.Get("after"); len(after) > 0 {
+			filter.After, err = wiki.resolveVersion(after)
+			if err == nil && len(filter.After) == 0 {
+				ctx.statusCode = http.StatusNotFound
+				err = errors.New("version " + after + " not found")
+			}
+		}
+		if ctx.Since = q.Get("since"); err == nil && len(ctx.Since) > 0 {
+			filter.Since, err = parseSinceDate(ctx.Since)
+		}
+		if ctx.Until = q.Get("until"); err == nil && len(ctx.Until) > 0 {
+			filter.Until, err = parseVersionDate(ctx.Until)
+		}
+		if err == nil {
+			err = ctx.History(histsize, filter, q.Get("format"))
+		}
 		if err != nil {
+			if ctx.statusCode == http.StatusOK {
+				ctx.statusCode = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), ctx.statusCode)
+		}
+		return
+	}
+
+	if doblame {
+		if r.Method != "GET" {
 			ctx.statusCode = http.StatusBadRequest
+			http.Error(w, r.Method+" method not allowed for blame", ctx.statusCode)
+			return
+		}
+		err = ctx.Blame(param_version)
+		if err != nil {
+			if ctx.statusCode == http.StatusOK {
+				ctx.statusCode = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), ctx.statusCode)
+		}
+		return
+	}
+
+	if dochanges {
+		if r.Method != "GET" {
+			ctx.statusCode = http.StatusBadRequest
+			http.Error(w, r.Method+" method not allowed for changes", ctx.statusCode)
+			return
+		}
+		size := wikiConfig.histsize
+		if len(changes_ary) > 0 && len(changes_ary[0]) > 0 {
+			size, err = strconv.Atoi(changes_ary[0])
+			if err != nil {
+				size = wikiConfig.histsize
+			}
+		}
+		// changes under the requested directory, a feed if feed=atom|rss
+		_, hide_minor := q["hideminor"]
+		err = ctx.RecentChanges(strings.Trim(fp, "/"), q.Get("author"), size, q.Get("feed"), hide_minor)
+		if err != nil {
+			if ctx.statusCode == http.StatusOK {
+				ctx.statusCode = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), ctx.statusCode)
+		}
+		return
+	}
+
+	if doarchive {
+		if r.Method != "GET" {
+			ctx.statusCode = http.StatusBadRequest
+			http.Error(w, r.Method+" method not allowed for archive", ctx.statusCode)
+			return
+		}
+		format := ARCHIVE_ZIP
+		if len(archive_ary) > 0 && len(archive_ary[0]) > 0 {
+			format = archive_ary[0]
+		}
+		ctx.path = fp
+		err = ctx.Archive(format, ctx.Version)
+		if err != nil {
+			if ctx.statusCode == http.StatusOK {
+				ctx.statusCode = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), ctx.statusCode)
+		}
+		return
+	}
+
+	if docommit {
+		if r.Method != "GET" {
+			ctx.statusCode = http.StatusBadRequest
+			http.Error(w, r.Method+" method not allowed for commit", ctx.statusCode)
+			return
+		}
+		// the latest commit by default
+		commit := ctx.Version
+		if len(commit_ary) > 0 && len(commit_ary[0]) > 0 {
+			commit = commit_ary[0]
+		}
+		err = ctx.ShowCommit(commit)
+		if err != nil {
+			if ctx.statusCode == http.StatusOK {
+				ctx.statusCode = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), ctx.statusCode)
+		}
+		return
+	}
+
+	if dodeleted {
+		if r.Method != "GET" {
+			ctx.statusCode = http.StatusBadRequest
+			http.Error(w, r.Method+" method not allowed for deleted", ctx.statusCode)
+			return
+		}
+		// deleted pages under the requested directory
+		err = ctx.ListDeleted(strings.Trim(fp, "/"))
+		if err != nil {
+			if ctx.statusCode == http.StatusOK {
+				ctx.statusCode = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), ctx.statusCode)
+		}
+		return
+	}
+
+	if dorestore {
+		if r.Method != "POST" {
+			ctx.statusCode = http.StatusBadRequest
+			http.Error(w, r.Method+" method not allowed for restore", ctx.statusCode)
+			return
+		}
+		// the last version before deleted by default
+		version := ""
+		if len(restore_ary) > 0 {
+			version = restore_ary[0]
+		}
+		err = ctx.Restore(version)
+		if err != nil {
+			if ctx.statusCode == http.StatusOK {
+				ctx.statusCode = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), ctx.statusCode)
+		}
+		return
+	}
+
+	if dosnapshots {
+		if r.Method == "GET" {
+			err = ctx.ListSnapshots()
+		} else if r.Method == "POST" {
+			err = ctx.CreateSnapshot()
+		} else {
+			ctx.statusCode = http.StatusBadRequest
+			http.Error(w, r.Method+" method not allowed for snapshots", ctx.statusCode)
+			return
+		}
+		if err != nil {
+			if ctx.statusCode == http.StatusOK {
+				ctx.statusCode = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), ctx.statusCode)
+		}
+		return
+	}
+
+	if dobranches {
+		if r.Method != "GET" {
+			ctx.statusCode = http.StatusBadRequest
+			http.Error(w, r.Method+" method not allowed for branches", ctx.statusCode)
+			return
+		}
+		err = ctx.ListBranches()
+		if err != nil {
+			if ctx.statusCode == http.StatusOK {
+				ctx.statusCode = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), ctx.statusCode)
+		}
+		return
+	}
+
+	if domerge {
+		if r.Method != "POST" {
+			ctx.statusCode = http.StatusBadRequest
+			http.Error(w, r.Method+" method not allowed for merge", ctx.statusCode)
+			return
+		}
+		if len(merge_ary) == 0 || len(merge_ary[0]) == 0 {
+			ctx.statusCode = http.StatusBadRequest
+			http.Error(w, "branch required for merge", ctx.statusCode)
+			return
+		}
+		err = ctx.MergeBranch(merge_ary[0])
+		if err != nil {
+			if ctx.statusCode == http.StatusOK {
+				ctx.statusCode = http.StatusBadRequest
+			}
 			http.Error(w, err.Error(), ctx.statusCode)
 		}
 		return
@@ -686,9 +1073,12 @@ func handleFunc(w http.ResponseWriter, r *http.Request) {
 		diff_param := diff_ary[0]
 		diff_parts := strings.Split(diff_param, ",")
 
+		ctx.DiffMode = q.Get("diffmode")
 		err = ctx.Diff(diff_parts)
 		if err != nil {
-			ctx.statusCode = http.StatusBadRequest
+			if ctx.statusCode == http.StatusOK {
+				ctx.statusCode = http.StatusBadRequest
+			}
 			http.Error(w, err.Error(), ctx.statusCode)
 		}
 		return
@@ -733,17 +1123,66 @@ func handleFunc(w http.ResponseWriter, r *http.Request) {
 
 	if dodelete {
 		if r.Method == "GET" {
-			// TODO: return delete template, confirm for delete operation
-		} else if r.Method == "POST" || r.Method == "DELETE" {
-			// TODO: delete operation
-			// if the file is in git, delete and commit
-			// else, just delete that file
-			// but, _static/ folder and favicon.ico should not be deleted
+			// return delete template, confirm for delete operation
+			err = ctx.ConfirmDelete()
+		} else if r.Method == "POST" {
+			err = ctx.Delete("redirect")
+		} else if r.Method == "DELETE" {
+			err = ctx.Delete("show_result")
 		} else {
 			ctx.statusCode = http.StatusBadRequest
-			http.Error(w, r.Method+" method not allowed for option", ctx.statusCode)
+			http.Error(w, r.Method+" method not allowed for delete", ctx.statusCode)
+			return
+		}
+		if err != nil {
+			if ctx.statusCode == http.StatusOK {
+				ctx.statusCode = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), ctx.statusCode)
+		}
+		return
+	}
+
+	if domove {
+		if r.Method != "POST" {
+			ctx.statusCode = http.StatusBadRequest
+			http.Error(w, r.Method+" method not allowed for move", ctx.statusCode)
+			return
+		}
+		if len(move_ary) == 0 || len(move_ary[0]) == 0 {
+			ctx.statusCode = http.StatusBadRequest
+			http.Error(w, "new path required for move", ctx.statusCode)
 			return
 		}
+		// leave a redirect stub at the old path, unless redirect=false
+		err = ctx.Move(move_ary[0], q.Get("redirect") != "false")
+		if err != nil {
+			if ctx.statusCode == http.StatusOK {
+				ctx.statusCode = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), ctx.statusCode)
+		}
+		return
+	}
+
+	if dorevert {
+		if r.Method != "POST" {
+			ctx.statusCode = http.StatusBadRequest
+			http.Error(w, r.Method+" method not allowed for revert", ctx.statusCode)
+			return
+		}
+		if len(revert_ary) == 0 || len(revert_ary[0]) == 0 {
+			ctx.statusCode = http.StatusBadRequest
+			http.Error(w, "version required for revert", ctx.statusCode)
+			return
+		}
+		err = ctx.Revert(revert_ary[0])
+		if err != nil {
+			if ctx.statusCode == http.StatusOK {
+				ctx.statusCode = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), ctx.statusCode)
+		}
 		return
 	}
 
@@ -798,11 +1237,42 @@ func handleFunc(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "POST" || r.Method == "PUT" {
 		// no edit, so upload to fp
 		ctx.path = fp
-		if doupload {
+		if doupload && len(upload_ary) > 0 && upload_ary[0] == "archive" {
+			err = ctx.UploadArchive()
+		} else if doupload {
 			err = ctx.Update("show_result")
 		} else {
 			err = ctx.Update("redirect")
 		}
+	} else if r.Method == "GET" && (len(ctx.Branch) > 0 || len(param_version) > 0) {
+		// pages of a draft branch or an old version are read from git instead of the working tree
+		// links in directory listings keep the version or branch
+		pinned := doversion && len(version_ary) > 0 && len(version_ary[0]) > 0
+		link_query := "branch=" + url.QueryEscape(ctx.Branch)
+		if pinned {
+			link_query = "version=" + url.QueryEscape(version_ary[0])
+		}
+		if content, _ := wiki.getFileOfVersion(fpmd, ctx.Version); content != nil {
+			ctx.path = fpmd
+			err = ctx.View(ctx.Version)
+		} else if wiki.isDirOfVersion(fp, ctx.Version) {
+			ctx.path = fp
+			if len(fp) > 0 && !strings.HasSuffix(fp, "/") {
+				err = ctx.Redirect(r.URL.Path + "/?" + r.URL.RawQuery)
+			} else {
+				err = ctx.ListdirOfVersion(ctx.Version, link_query)
+			}
+		} else if content, _ := wiki.getFileOfVersion(fp, ctx.Version); content != nil {
+			ctx.path = fp
+			err = ctx.Static(ctx.Version)
+		} else if !pinned {
+			// a new page of the draft branch
+			ctx.path = fpmd
+			err = ctx.Edit(ctx.Version)
+		} else {
+			ctx.statusCode = http.StatusNotFound
+			err = errors.New("/" + fp + " does not exist at version " + version_ary[0])
+		}
 	} else if r.Method == "GET" {
 		if fpmderr == nil { // fpmd exists, just view
 			if fpmdstat.IsDir() { // sadly, fpmd is a directory, show error
@@ -831,8 +1301,12 @@ func handleFunc(w http.ResponseWriter, r *http.Request) {
 				ctx.Static(param_version)
 			}
 		} else { // both fp and fpmd does not exists
-			ctx.path = fpmd
-			err = ctx.Edit(param_version)
+			if target := wiki.getRedirect(fpmd); len(target) > 0 && !doversion { // the page has been moved
+				err = ctx.Redirect(wiki.link(target))
+			} else {
+				ctx.path = fpmd
+				err = ctx.Edit(param_version)
+			}
 		}
 	} else {
 		// method not allowed
@@ -927,51 +1401,49 @@ func main() {
 
 	bootstrap()
 
-	// try open the repo
-	repo, err := git.OpenRepository(".")
-	if err != nil {
+	// try open the repo, it is shared by all requests
+	mainWiki = &Wiki{Prefix: "/", Dir: "."}
+	if err := mainWiki.open(); err != nil {
 		log.Printf("git repository not found at current directory. please use `-init` switch or run `git init` in this directory")
 		log.Fatal(err)
 		os.Exit(2)
-	} else {
-		repo.Free()
-	}
-
-	// load auth file
-	if _, err := os.Stat(wikiConfig.auth); len(wikiConfig.auth) > 0 && (!os.IsNotExist(err)) {
-		authenticator = auth.NewBasicAuthenticator("strapdown.ztx.io", auth.HtpasswdFileProvider(wikiConfig.auth)) // should we replace the url here?
-		log.Printf("use authentication file: %s", wikiConfig.auth)
-	} else {
-		log.Printf("authentication file not exist, disable http authentication")
 	}
 
-	if _, err := os.Stat(".md"); os.IsNotExist(err) {
-		// release a default .md
-		log.Print("Release default .md")
-
-		file, err := Asset("_static/.md")
-		if err != nil {
-			log.Printf("[ WARN ] fail to load .md")
+	if len(wikiConfig.export) > 0 {
+		// export and exit
+		if err := mainWiki.exportSite(wikiConfig.export, wikiConfig.exportversion); err != nil {
+			log.Fatalf("export failed: %v", err)
 		}
-		err = ioutil.WriteFile(".md", file, 0644)
-		if err != nil {
-			log.Printf("[ WARN ] cannot write default .md: %v", err)
+		os.Exit(0)
+	}
+	if len(wikiConfig.importsrc) > 0 {
+		// import and exit
+		if err := mainWiki.importWiki(wikiConfig.importsrc, wikiConfig.importformat); err != nil {
+			log.Fatalf("import failed: %v", err)
 		}
+		os.Exit(0)
 	}
 
-	if _, err := os.Stat("favicon.ico"); os.IsNotExist(err) {
-		// release the files
-		log.Print("Release the favicon.ico")
-
-		file, err := Asset("_static/fav.ico")
+	all := []*Wiki{mainWiki}
+	if len(wikiConfig.mounts) > 0 {
+		mounts, err := loadMounts(wikiConfig.mounts)
 		if err != nil {
-			log.Printf("[ WARN ] fail to load favicon.ico")
+			log.Fatal(err)
 		}
-		err = ioutil.WriteFile("favicon.ico", file, 0644)
-		if err != nil {
-			log.Printf("[ WARN ] cannot write default favicon.ico: %v", err)
+		for _, wiki := range mounts {
+			if err = wiki.open(); err != nil {
+				log.Fatalf("cannot open the wiki %s at %s: %v", wiki.Prefix, wiki.Dir, err)
+			}
+			log.Printf("mount %s at %s", wiki.Dir, wiki.Prefix)
+			all = append(all, wiki)
 		}
 	}
+	setWikis(all)
+	for _, wiki := range wikis {
+		wiki.prepare()
+	}
+
+	startSync()
 
 	// callback.md cannot be created and edited under current authentication mechanism
 	http.HandleFunc("/", handleFunc)
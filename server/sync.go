@@ -0,0 +1,318 @@
+package main
+
+import (
+	"errors"
+	"github.com/libgit2/git2go"
+	"log"
+	"strings"
+	"time"
+)
+
+// keep the wiki repository in sync with a git remote
+// every commit made by the wiki is pushed to the remote, and remote changes are pulled periodically
+
+const (
+	SYNC_POLICY_MERGE  = "merge"  // create a merge commit when histories diverge
+	SYNC_POLICY_REFUSE = "refuse" // leave the diverged histories alone and complain in the log
+)
+
+// coalesced push requests, one pending request is enough
+var pushRequest = make(chan bool, 1)
+
+// request a push after a commit, it never blocks
+func requestPush() {
+	if len(wikiConfig.remote) == 0 {
+		return
+	}
+	select {
+	case pushRequest <- true:
+	default:
+	}
+}
+
+func startSync() {
+	if len(wikiConfig.remote) == 0 {
+		return
+	}
+	if wikiConfig.syncpolicy != SYNC_POLICY_MERGE && wikiConfig.syncpolicy != SYNC_POLICY_REFUSE {
+		log.Fatalf("unknown sync policy %s, should be %s or %s", wikiConfig.syncpolicy, SYNC_POLICY_MERGE, SYNC_POLICY_REFUSE)
+	}
+	log.Printf("sync with remote %s every %v, policy %s", wikiConfig.remote, wikiConfig.syncinterval, wikiConfig.syncpolicy)
+
+	go func() {
+		var tick <-chan time.Time
+		if wikiConfig.syncinterval > 0 {
+			tick = time.NewTicker(wikiConfig.syncinterval).C
+		}
+		// pull once at startup
+		if err := pullRemote(); err != nil {
+			log.Printf("[ WARN ] sync with %s failed: %v", wikiConfig.remote, err)
+		}
+		for {
+			var err error
+			select {
+			case <-pushRequest:
+				err = pushRemote()
+			case <-tick:
+				err = pullRemote()
+			}
+			if err != nil {
+				log.Printf("[ WARN ] sync with %s failed: %v", wikiConfig.remote, err)
+			}
+		}
+	}()
+}
+
+// -remote could be the name of a configured remote, or an url
+func openRemote(repo *git.Repository) (*git.Remote, error) {
+	if remote, err := repo.Remotes.Lookup(wikiConfig.remote); err == nil {
+		return remote, nil
+	}
+	return repo.Remotes.CreateAnonymous(wikiConfig.remote)
+}
+
+func remoteCallbacks() git.RemoteCallbacks {
+	return git.RemoteCallbacks{
+		CredentialsCallback: func(url string, username_from_url string, allowed_types git.CredType) (git.ErrorCode, *git.Cred) {
+			if allowed_types&git.CredTypeSshKey != 0 {
+				// ssh, ask the ssh-agent
+				ret, cred := git.NewCredSshKeyFromAgent(username_from_url)
+				return git.ErrorCode(ret), &cred
+			}
+			return git.ErrUser, nil
+		},
+	}
+}
+
+// the branch HEAD points to, e.g. refs/heads/master, even if it is not born yet
+func headBranch(repo *git.Repository) (string, error) {
+	head, err := repo.References.Lookup("HEAD")
+	if err != nil {
+		return "", err
+	}
+	defer head.Free()
+	branch := head.SymbolicTarget()
+	if len(branch) == 0 {
+		return "", errors.New("HEAD is detached")
+	}
+	return branch, nil
+}
+
+func pushRemote() error {
+	repo, err := mainWiki.repo.Open()
+	if err != nil {
+		return err
+	}
+	defer mainWiki.repo.Release(repo)
+
+	remote, err := openRemote(repo)
+	if err != nil {
+		return err
+	}
+	defer remote.Free()
+
+	branch, err := headBranch(repo)
+	if err != nil {
+		return err
+	}
+	if wikiConfig.verbose {
+		log.Printf("[ DEBUG ] push %s to %s", branch, wikiConfig.remote)
+	}
+	return remote.Push([]string{branch + ":" + branch}, &git.PushOptions{RemoteCallbacks: remoteCallbacks()})
+}
+
+// fetch the remote, then fast-forward or merge the changes into the working tree
+func pullRemote() error {
+	repo, err := mainWiki.repo.Open()
+	if err != nil {
+		return err
+	}
+	defer mainWiki.repo.Release(repo)
+
+	remote, err := openRemote(repo)
+	if err != nil {
+		return err
+	}
+	defer remote.Free()
+
+	branch, err := headBranch(repo)
+	if err != nil {
+		return err
+	}
+	remoteName := remote.Name()
+	if len(remoteName) == 0 {
+		remoteName = "sync"
+	}
+	tracking := "refs/remotes/" + remoteName + "/" + strings.TrimPrefix(branch, "refs/heads/")
+
+	err = remote.Fetch([]string{"+" + branch + ":" + tracking}, &git.FetchOptions{RemoteCallbacks: remoteCallbacks()}, "")
+	if err != nil {
+		return err
+	}
+
+	trackingRef, err := repo.References.Lookup(tracking)
+	if err != nil {
+		// the remote branch does not exist yet, just push
+		return pushRemote()
+	}
+	theirs := trackingRef.Target()
+	trackingRef.Free()
+
+	return mainWiki.repo.Write(func(repo *git.Repository, index *git.Index) error {
+		head, err := repo.Head()
+		if err != nil {
+			// nothing committed locally
+			return fastForward(repo, branch, theirs)
+		}
+		defer head.Free()
+		ours := head.Target()
+
+		if ours.Equal(theirs) {
+			return nil
+		}
+		base, err := repo.MergeBase(ours, theirs)
+		if err != nil {
+			return err
+		}
+		if base.Equal(theirs) {
+			// local is ahead
+			requestPush()
+			return nil
+		}
+		if base.Equal(ours) {
+			return fastForward(repo, branch, theirs)
+		}
+
+		if wikiConfig.syncpolicy != SYNC_POLICY_MERGE {
+			log.Printf("[ WARN ] wiki history has diverged from %s (local %s, remote %s), refuse to merge, please resolve it manually", wikiConfig.remote, ours, theirs)
+			return nil
+		}
+		err = mergeRemote(repo, ours, theirs)
+		if err != nil {
+			return err
+		}
+		requestPush()
+		return nil
+	})
+}
+
+func fastForward(repo *git.Repository, branch string, target *git.Oid) error {
+	err := updateBranch(repo, branch, target, "sync: fast-forward to "+target.String())
+	if err != nil {
+		return err
+	}
+	log.Printf("fast-forward to %s from %s", target, wikiConfig.remote)
+	return nil
+}
+
+// point the branch to target, and update the working tree from the old tree to the new one
+// it should run in the write queue when branch is the current branch
+func updateBranch(repo *git.Repository, branch string, target *git.Oid, msg string) error {
+	commit, err := repo.LookupCommit(target)
+	if err != nil {
+		return err
+	}
+	defer commit.Free()
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+	defer tree.Free()
+
+	// safe checkout refuses to overwrite uncommitted changes
+	err = repo.CheckoutTree(tree, &git.CheckoutOptions{Strategy: git.CheckoutSafe})
+	if err != nil {
+		return err
+	}
+	ref, err := repo.References.Create(branch, target, true, msg)
+	if err != nil {
+		return err
+	}
+	ref.Free()
+	return nil
+}
+
+func mergeRemote(repo *git.Repository, ours *git.Oid, theirs *git.Oid) error {
+	sig := &git.Signature{
+		Name:  DEFAULT_AUTHOR_NAME,
+		Email: DEFAULT_AUTHOR_EMAIL,
+		When:  time.Now(),
+	}
+	conflicts, err := mergeIntoHead(repo, ours, theirs, sig, "merge changes from "+wikiConfig.remote)
+	if err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		log.Printf("[ WARN ] wiki history has diverged from %s (local %s, remote %s) with conflicts in %s, please resolve it manually", wikiConfig.remote, ours, theirs, strings.Join(conflicts, ", "))
+		return nil
+	}
+	log.Printf("merged %s from %s", theirs, wikiConfig.remote)
+	return nil
+}
+
+// create a merge commit of ours (HEAD) and theirs, and update the working tree
+// nothing is changed if there are conflicts, the conflicting paths are returned instead
+// it should run in the write queue
+func mergeIntoHead(repo *git.Repository, ours *git.Oid, theirs *git.Oid, sig *git.Signature, msg string) ([]string, error) {
+	ourCommit, err := repo.LookupCommit(ours)
+	if err != nil {
+		return nil, err
+	}
+	defer ourCommit.Free()
+
+	theirCommit, err := repo.LookupCommit(theirs)
+	if err != nil {
+		return nil, err
+	}
+	defer theirCommit.Free()
+
+	index, err := repo.MergeCommits(ourCommit, theirCommit, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer index.Free()
+
+	if index.HasConflicts() {
+		iter, err := index.ConflictIterator()
+		if err != nil {
+			return nil, err
+		}
+		defer iter.Free()
+		var conflicts []string
+		for {
+			conflict, err := iter.Next()
+			if err != nil {
+				break
+			}
+			for _, entry := range []*git.IndexEntry{conflict.Our, conflict.Their, conflict.Ancestor} {
+				if entry != nil {
+					conflicts = append(conflicts, entry.Path)
+					break
+				}
+			}
+		}
+		if len(conflicts) == 0 {
+			return nil, errors.New("merge has conflicts")
+		}
+		return conflicts, nil
+	}
+
+	treeId, err := index.WriteTreeTo(repo)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := repo.LookupTree(treeId)
+	if err != nil {
+		return nil, err
+	}
+	defer tree.Free()
+
+	err = repo.CheckoutTree(tree, &git.CheckoutOptions{Strategy: git.CheckoutSafe})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = repo.CreateCommit("HEAD", sig, sig, msg, tree, ourCommit, theirCommit)
+	return nil, err
+}
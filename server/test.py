@@ -13,6 +13,12 @@ import requests
 import time
 import shutil
 import json
+import threading
+import io
+import zipfile
+import tarfile
+import base64
+import hashlib
 
 CWD = os.path.dirname(os.path.realpath(__file__))
 
@@ -56,8 +62,10 @@ class Test(unittest.TestCase):
         if not os.path.exists("./" + BIN):
             print './%s not found' % BIN
             sys.exit(10)
+        self.start()
 
-        args = ["./" + BIN, "-verbose", "-dir=" + self.cwd, "-toc=true", "-title=" + self.title, "-init", "-heading_number=i", "-addr=" + ','.join(map(lambda x: '127.0.0.1:%d' % x, self.ports))]
+    def start(self, extra_args=[]):
+        args = ["./" + self.binary, "-verbose", "-dir=" + self.cwd, "-toc=true", "-title=" + self.title, "-init", "-heading_number=i", "-addr=" + ','.join(map(lambda x: '127.0.0.1:%d' % x, self.ports))] + extra_args
         print args
         self.proc = subprocess.Popen(args, stdout=subprocess.PIPE)
 
@@ -74,6 +82,12 @@ class Test(unittest.TestCase):
         self.ports = filter(check_port, self.ports)
         self.assertGreater(len(self.ports), 0)
 
+    def restart(self, extra_args=[]):
+        self.proc.terminate()
+        self.proc.wait()
+        self.ports = [random.randint(60000, 65535) for x in range(4)]
+        self.start(extra_args)
+
     def tearDown(self):
         self.proc.terminate()
         self.proc.wait()
@@ -378,6 +392,1167 @@ class Test(unittest.TestCase):
         self.assertLess(r.status_code, 300)
 
 
+    def test_delete(self):
+        r = requests.post(self.url("/test_delete?edit"), data={
+            "body": "# test delete\n\n"
+        })
+        self.assertGreaterEqual(r.status_code, 200)
+        self.assertLess(r.status_code, 300)
+        self.writefile("test_delete.md.head", "head")
+
+        r = requests.get(self.url("/test_delete?delete"))
+        self.assertEqual(r.status_code, 200)
+        self.assertIn('action="?delete"', r.text)
+
+        r = requests.post(self.url("/test_delete?delete"), allow_redirects=False)
+        self.assertIn(r.status_code, [301, 302, 303, 307, 308], r.status_code)
+        self.assertFalse(os.path.exists(os.path.join(self.cwd, "test_delete.md")))
+        self.assertFalse(os.path.exists(os.path.join(self.cwd, "test_delete.md.head")))
+
+        r = requests.get(self.url("/test_delete.md?history"))
+        self.assertIn("upload to test_delete.md", r.text)
+
+        r = requests.delete(self.url("/test_delete?delete"))
+        self.assertEqual(r.status_code, 404)
+
+        r = requests.delete(self.url("/favicon.ico?delete"))
+        self.assertEqual(r.status_code, 403)
+        self.assertTrue(os.path.exists(os.path.join(self.cwd, "favicon.ico")))
+
+    def test_move(self):
+        r = requests.post(self.url("/test_move?edit"), data={
+            "body": "# test move\n\n"
+        })
+        self.assertGreaterEqual(r.status_code, 200)
+        self.assertLess(r.status_code, 300)
+
+        r = requests.post(self.url("/test_move?move=moved/test_move"), allow_redirects=False)
+        self.assertIn(r.status_code, [301, 302, 303, 307, 308], r.status_code)
+        self.assertEqual(r.headers['Location'], "/moved/test_move")
+        self.assertFalse(os.path.exists(os.path.join(self.cwd, "test_move.md")))
+        self.assertEqual(self.readfile("moved/test_move.md"), "# test move\n\n")
+
+        # the old url redirects to the new location
+        r = requests.get(self.url("/test_move"), allow_redirects=False)
+        self.assertIn(r.status_code, [301, 302, 303, 307, 308], r.status_code)
+        self.assertEqual(r.headers['Location'], "/moved/test_move")
+
+        # history follows the rename
+        r = requests.get(self.url("/moved/test_move?history"))
+        self.assertIn("move test_move.md to moved/test_move.md", r.text)
+        self.assertIn("upload to test_move.md", r.text)
+
+        r = requests.post(self.url("/moved/test_move?move=.git/test_move"), allow_redirects=False)
+        self.assertEqual(r.status_code, 403)
+
+        self.writefile("exists.md", "exists")
+        r = requests.post(self.url("/moved/test_move?move=exists"), allow_redirects=False)
+        self.assertEqual(r.status_code, 409)
+
+        # a leftover sidecar of the target blocks the move as well, nothing is renamed
+        self.writefile("sidecar.md.head", "head")
+        r = requests.post(self.url("/moved/test_move?move=sidecar"), allow_redirects=False)
+        self.assertEqual(r.status_code, 409)
+        self.assertEqual(self.readfile("moved/test_move.md"), "# test move\n\n")
+        self.assertEqual(self.readfile("sidecar.md.head"), "head")
+        self.assertFalse(os.path.exists(os.path.join(self.cwd, "sidecar.md")))
+
+    def test_edit_conflict(self):
+        r = requests.post(self.url("/test_conflict?edit"), data={
+            "body": "a\nb\nc\nd\ne\n"
+        })
+        self.assertGreaterEqual(r.status_code, 200)
+        self.assertLess(r.status_code, 300)
+        base = self.readfile(".git/refs/heads/master").strip()
+
+        r = requests.get(self.url("/test_conflict?edit"))
+        self.assertIn('name="version" value="%s"' % base, r.text)
+
+        r = requests.post(self.url("/test_conflict?edit"), data={
+            "body": "A\nb\nc\nd\ne\n",
+            "version": base
+        })
+        self.assertGreaterEqual(r.status_code, 200)
+        self.assertLess(r.status_code, 300)
+
+        # not overlapped with the last save, merged
+        r = requests.post(self.url("/test_conflict?edit"), data={
+            "body": "a\nb\nc\nd\nE\n",
+            "version": base
+        })
+        self.assertGreaterEqual(r.status_code, 200)
+        self.assertLess(r.status_code, 300)
+        self.assertEqual(self.readfile("test_conflict.md"), "A\nb\nc\nd\nE\n")
+
+        # overlapped, conflict markers sent back
+        r = requests.post(self.url("/test_conflict?edit"), data={
+            "body": "X\nb\nc\nd\ne\n",
+            "version": base
+        })
+        self.assertEqual(r.status_code, 409)
+        self.assertIn("<<<<<<< current", r.text)
+        self.assertEqual(self.readfile("test_conflict.md"), "A\nb\nc\nd\nE\n")
+
+    def test_concurrent_edit(self):
+        r = requests.post(self.url("/test_concurrent?edit"), data={
+            "body": "a\nb\nc\nd\ne\n"
+        })
+        self.assertGreaterEqual(r.status_code, 200)
+        self.assertLess(r.status_code, 300)
+        base = self.readfile(".git/refs/heads/master").strip()
+
+        # both saves start from the same version, none of them may be lost silently
+        edits = {"A": "A\nb\nc\nd\ne\n", "E": "a\nb\nc\nd\nE\n"}
+        results = {}
+        def save(line):
+            r = requests.post(self.url("/test_concurrent?edit"), data={
+                "body": edits[line],
+                "version": base
+            })
+            results[line] = r.status_code
+        threads = [threading.Thread(target=save, args=(line,)) for line in edits]
+        for t in threads:
+            t.start()
+        for t in threads:
+            t.join()
+
+        content = self.readfile("test_concurrent.md")
+        if 409 in results.values():
+            self.assertEqual(results.values().count(409), 1, repr(results))
+        else:
+            self.assertEqual(content, "A\nb\nc\nd\nE\n")
+        for line, status in results.items():
+            if status != 409:
+                self.assertGreaterEqual(status, 200)
+                self.assertLess(status, 300)
+                self.assertIn(line, content.split("\n"))
+
+    def test_revert(self):
+        r = requests.post(self.url("/test_revert?edit"), data={
+            "body": "old content"
+        })
+        self.assertGreaterEqual(r.status_code, 200)
+        self.assertLess(r.status_code, 300)
+        old = self.readfile(".git/refs/heads/master").strip()
+
+        r = requests.post(self.url("/test_revert?edit"), data={
+            "body": "new content"
+        })
+        self.assertGreaterEqual(r.status_code, 200)
+        self.assertLess(r.status_code, 300)
+
+        r = requests.post(self.url("/test_revert?revert=%s" % old[:13]), allow_redirects=False)
+        self.assertIn(r.status_code, [301, 302, 303, 307, 308], r.status_code)
+        self.assertEqual(self.readfile("test_revert.md"), "old content")
+
+        r = requests.get(self.url("/test_revert?history"))
+        self.assertIn("revert test_revert.md to %s" % old[:11], r.text)
+
+        # the page does not exist in the first commit, revert to it means deletion
+        r = requests.post(self.url("/?edit"), data={
+            "body": "# index"
+        })
+        first = self.readfile(".git/refs/heads/master").strip()
+        r = requests.post(self.url("/test_revert2?edit"), data={
+            "body": "will be deleted"
+        })
+        r = requests.post(self.url("/test_revert2?revert=%s" % first), allow_redirects=False)
+        self.assertIn(r.status_code, [301, 302, 303, 307, 308], r.status_code)
+        self.assertFalse(os.path.exists(os.path.join(self.cwd, "test_revert2.md")))
+
+        # and revert back brings it back
+        r = requests.get(self.url("/test_revert2.md?history"))
+        version = re.findall(r'<a href="\?version=([0-9a-f]{40})">', r.text)[0]
+        r = requests.post(self.url("/test_revert2?revert=%s" % version), allow_redirects=False)
+        self.assertIn(r.status_code, [301, 302, 303, 307, 308], r.status_code)
+        self.assertEqual(self.readfile("test_revert2.md"), "will be deleted")
+
+        r = requests.get(self.url("/test_revert?revert=%s" % old))
+        self.assertEqual(r.status_code, 400)
+
+    def test_blame(self):
+        r = requests.post(self.url("/test_blame?edit"), data={
+            "body": "first line\nsecond line\n"
+        })
+        self.assertGreaterEqual(r.status_code, 200)
+        self.assertLess(r.status_code, 300)
+        first = self.readfile(".git/refs/heads/master").strip()
+
+        r = requests.post(self.url("/test_blame?edit"), data={
+            "body": "first line\nsecond line changed\n"
+        })
+        second = self.readfile(".git/refs/heads/master").strip()
+
+        r = requests.get(self.url("/test_blame?blame"))
+        self.assertEqual(r.status_code, 200)
+        self.assertIn('<a href="?version=%s"' % first, r.text)
+        self.assertIn('<a href="?version=%s"' % second, r.text)
+        self.assertIn("second line changed", r.text)
+
+        r = requests.get(self.url("/test_blame?blame&version=%s" % first))
+        self.assertEqual(r.status_code, 200)
+        self.assertNotIn(second, r.text)
+        self.assertIn("second line", r.text)
+
+        r = requests.get(self.url("/test_blame_not_exists?blame"))
+        self.assertEqual(r.status_code, 404)
+
+    def wait_until(self, cond, timeout=10):
+        for i in range(timeout * 10):
+            if cond():
+                return True
+            time.sleep(0.1)
+        return False
+
+    def test_sync_remote(self):
+        bare = tempfile.mkdtemp()
+        tmpfolders.append(bare)
+        subprocess.check_call(["git", "init", "-q", "--bare", bare])
+        self.restart(["-remote=" + bare, "-sync_interval=1s"])
+
+        r = requests.post(self.url("/test_sync?edit"), data={
+            "body": "pushed by wiki"
+        })
+        self.assertGreaterEqual(r.status_code, 200)
+        self.assertLess(r.status_code, 300)
+        remote_head = lambda: subprocess.check_output(["git", "--git-dir=" + bare, "rev-parse", "refs/heads/master"]).strip()
+        self.assertTrue(self.wait_until(lambda: remote_head() == self.readfile(".git/refs/heads/master").strip()))
+
+        # changes pushed to the remote are fast-forwarded into the wiki
+        clone = tempfile.mkdtemp()
+        tmpfolders.append(clone)
+        subprocess.check_call(["git", "clone", "-q", bare, clone])
+        f = open(os.path.join(clone, "test_sync.md"), "w")
+        f.write("pushed by git")
+        f.close()
+        git = ["git", "-C", clone, "-c", "user.name=test", "-c", "user.email=test@example.com"]
+        subprocess.check_call(git + ["commit", "-q", "-am", "update from git"])
+        subprocess.check_call(git + ["push", "-q", "origin", "master"])
+        self.assertTrue(self.wait_until(lambda: self.readfile("test_sync.md") == "pushed by git"))
+
+        # diverged history is merged with the default policy
+        f = open(os.path.join(clone, "other.md"), "w")
+        f.write("other page")
+        f.close()
+        subprocess.check_call(git + ["add", "other.md"])
+        subprocess.check_call(git + ["commit", "-q", "-m", "add other page"])
+        subprocess.check_call(git + ["push", "-q", "origin", "master"])
+        r = requests.post(self.url("/test_sync2?edit"), data={
+            "body": "another page by wiki"
+        })
+        self.assertTrue(self.wait_until(lambda: os.path.exists(os.path.join(self.cwd, "other.md"))))
+        self.assertTrue(self.wait_until(lambda: remote_head() == self.readfile(".git/refs/heads/master").strip()))
+
+    def test_git_http(self):
+        r = requests.post(self.url("/test_git_http?edit"), data={
+            "body": "served over http"
+        })
+        self.assertGreaterEqual(r.status_code, 200)
+        self.assertLess(r.status_code, 300)
+
+        r = requests.get(self.url("/info/refs?service=git-upload-pack"))
+        self.assertEqual(r.headers['Content-Type'], "application/x-git-upload-pack-advertisement")
+        self.assertIn(self.readfile(".git/refs/heads/master").strip(), r.text)
+
+        # raw access of .git is still forbidden
+        r = requests.get(self.url("/.git/config"))
+        self.assertEqual(r.status_code, 403)
+
+        clone = tempfile.mkdtemp()
+        tmpfolders.append(clone)
+        subprocess.check_call(["git", "clone", "-q", self.url("/"), clone])
+        self.assertEqual(open(os.path.join(clone, "test_git_http.md")).read(), "served over http")
+
+        f = open(os.path.join(clone, "test_git_http.md"), "w")
+        f.write("pushed over http")
+        f.close()
+        git = ["git", "-C", clone, "-c", "user.name=test", "-c", "user.email=test@example.com"]
+        subprocess.check_call(git + ["commit", "-q", "-am", "update over http"])
+        subprocess.check_call(git + ["push", "-q", "origin", "master"])
+        self.assertEqual(self.readfile("test_git_http.md"), "pushed over http")
+        r = requests.get(self.url("/test_git_http"))
+        self.assertIn("pushed over http", r.text)
+
+        # fetch after more edits in the wiki
+        r = requests.post(self.url("/test_git_http?edit"), data={
+            "body": "edited in wiki"
+        })
+        subprocess.check_call(git + ["pull", "-q", "origin", "master"])
+        self.assertEqual(open(os.path.join(clone, "test_git_http.md")).read(), "edited in wiki")
+
+        # pushed files go through the same checks as edits
+        for name, content in [(".htpasswd", "mallory:{SHA}x\n"), ("test_git_http_xmp.md", "</xmp><script>alert(1)</script>")]:
+            f = open(os.path.join(clone, name), "w")
+            f.write(content)
+            f.close()
+            subprocess.check_call(git + ["add", name])
+            subprocess.check_call(git + ["commit", "-q", "-m", "push " + name])
+            p = subprocess.Popen(git + ["push", "origin", "master"], stdout=subprocess.PIPE, stderr=subprocess.STDOUT)
+            out = p.communicate()[0]
+            self.assertNotEqual(p.returncode, 0, out)
+            self.assertIn("remote rejected", out)
+            self.assertFalse(os.path.exists(os.path.join(self.cwd, name)), name)
+            subprocess.check_call(git + ["reset", "-q", "--hard", "origin/master"])
+        self.assertEqual(self.readfile("test_git_http.md"), "edited in wiki")
+
+        # draft branches as well, they could be merged later
+        f = open(os.path.join(clone, ".htpasswd"), "w")
+        f.write("mallory:{SHA}x\n")
+        f.close()
+        subprocess.check_call(git + ["add", ".htpasswd"])
+        subprocess.check_call(git + ["commit", "-q", "-m", "push .htpasswd to a draft"])
+        p = subprocess.Popen(git + ["push", "origin", "master:refs/heads/test_git_http_draft"], stdout=subprocess.PIPE, stderr=subprocess.STDOUT)
+        out = p.communicate()[0]
+        self.assertNotEqual(p.returncode, 0, out)
+        self.assertIn("remote rejected", out)
+        self.assertFalse(os.path.exists(os.path.join(self.cwd, ".git", "refs", "heads", "test_git_http_draft")))
+        subprocess.check_call(git + ["reset", "-q", "--hard", "origin/master"])
+
+    def test_branch(self):
+        r = requests.post(self.url("/test_branch?edit"), data={
+            "body": "published"
+        })
+        self.assertGreaterEqual(r.status_code, 200)
+        self.assertLess(r.status_code, 300)
+
+        # edits on a draft branch do not touch the published page
+        r = requests.post(self.url("/test_branch?edit&branch=draft"), data={
+            "body": "drafted"
+        }, allow_redirects=False)
+        self.assertEqual(r.status_code, 302)
+        self.assertIn("branch=draft", r.headers["location"])
+        self.assertEqual(self.readfile("test_branch.md"), "published")
+        r = requests.post(self.url("/test_branch_new?edit&branch=draft"), data={
+            "body": "new page"
+        })
+        self.assertFalse(os.path.exists(os.path.join(self.cwd, "test_branch_new.md")))
+
+        r = requests.get(self.url("/test_branch?branch=draft"))
+        self.assertIn("drafted", r.text)
+        r = requests.get(self.url("/test_branch"))
+        self.assertIn("published", r.text)
+        r = requests.get(self.url("/test_branch_new?branch=draft"))
+        self.assertIn("new page", r.text)
+        r = requests.get(self.url("/test_branch?history&branch=draft"))
+        self.assertIn("update test_branch.md", r.text)
+
+        r = requests.get(self.url("/?branches"))
+        self.assertIn("draft", r.text)
+        self.assertIn("test_branch_new.md", r.text)
+
+        # merge folds the draft into the published pages, and removes the branch
+        r = requests.post(self.url("/?merge=draft"), allow_redirects=False)
+        self.assertEqual(r.status_code, 302)
+        self.assertEqual(self.readfile("test_branch.md"), "drafted")
+        self.assertEqual(self.readfile("test_branch_new.md"), "new page")
+        r = requests.get(self.url("/?branches"))
+        self.assertNotIn("test_branch_new.md", r.text)
+        r = requests.post(self.url("/?merge=draft"))
+        self.assertEqual(r.status_code, 404)
+
+        # both sides changed the same lines
+        r = requests.post(self.url("/test_branch?edit&branch=draft2"), data={
+            "body": "draft2"
+        })
+        r = requests.post(self.url("/test_branch?edit"), data={
+            "body": "master"
+        })
+        r = requests.post(self.url("/?merge=draft2"))
+        self.assertEqual(r.status_code, 409)
+        self.assertIn("test_branch.md", r.text)
+        self.assertEqual(self.readfile("test_branch.md"), "master")
+
+        # a draft made outside of the wiki cannot bring in files an edit could not write
+        clone = tempfile.mkdtemp()
+        tmpfolders.append(clone)
+        subprocess.check_call(["git", "clone", "-q", self.cwd, clone])
+        git = ["git", "-C", clone, "-c", "user.name=test", "-c", "user.email=test@example.com"]
+        f = open(os.path.join(clone, ".htpasswd"), "w")
+        f.write("mallory:{SHA}x\n")
+        f.close()
+        subprocess.check_call(git + ["add", ".htpasswd"])
+        subprocess.check_call(git + ["commit", "-q", "-m", "add .htpasswd"])
+        subprocess.check_call(git + ["push", "-q", "origin", "HEAD:refs/heads/draft3"])
+        r = requests.post(self.url("/?merge=draft3"))
+        self.assertEqual(r.status_code, 403)
+        self.assertFalse(os.path.exists(os.path.join(self.cwd, ".htpasswd")))
+
+    def test_parallel_update(self):
+        # concurrent posts are serialized by the commit queue, none of them should be lost
+        count = 40
+        errors = []
+
+        def post(i):
+            try:
+                r = requests.post(self.url("/test_parallel/%d?edit" % (i % 8)), data={
+                    "body": "content %d" % i
+                })
+                if r.status_code >= 300:
+                    errors.append(r.status_code)
+            except Exception as e:
+                errors.append(e)
+
+        threads = [threading.Thread(target=post, args=(i,)) for i in range(count)]
+        for t in threads:
+            t.start()
+        for t in threads:
+            t.join()
+        self.assertEqual(errors, [])
+
+        log = subprocess.check_output(["git", "log", "--format=%s"], cwd=self.cwd).splitlines()
+        self.assertEqual(len([l for l in log if "test_parallel/" in l]), count)
+        status = subprocess.check_output(["git", "status", "--porcelain"], cwd=self.cwd)
+        self.assertNotIn("test_parallel", status)
+
+    def test_version_syntax(self):
+        for body in ["first version", "second version", "third version"]:
+            r = requests.post(self.url("/test_version?edit"), data={
+                "body": body
+            })
+            self.assertGreaterEqual(r.status_code, 200)
+            self.assertLess(r.status_code, 300)
+        git = ["git", "-C", self.cwd]
+        first = subprocess.check_output(git + ["rev-parse", "HEAD~2"]).strip()
+        subprocess.check_call(git + ["tag", "-a", "-m", "first", "v1", first])
+
+        for version in ["HEAD~2", "v1", first[:7], first, "master~2"]:
+            r = requests.get(self.url("/test_version?version=%s" % version))
+            self.assertEqual(r.status_code, 200, version)
+            self.assertIn("first version", r.text, version)
+        r = requests.get(self.url("/test_version?version=HEAD~1"))
+        self.assertIn("second version", r.text)
+
+        # as of date, the whole history is before tomorrow and after yesterday
+        tomorrow = time.strftime("%Y-%m-%d", time.localtime(time.time() + 86400))
+        r = requests.get(self.url("/test_version?version=@{%s}" % tomorrow))
+        self.assertEqual(r.status_code, 200)
+        self.assertIn("third version", r.text)
+        yesterday = time.strftime("%Y-%m-%d", time.localtime(time.time() - 86400))
+        r = requests.get(self.url("/test_version?version=@{%s}" % yesterday))
+        self.assertEqual(r.status_code, 404)
+
+        for version in ["ffffffff", "HEAD~100", "nosuchtag", "HEAD:test_version.md"]:
+            r = requests.get(self.url("/test_version?version=%s" % version))
+            self.assertEqual(r.status_code, 404, version)
+        r = requests.get(self.url("/test_version?diff=HEAD~2,nosuchtag"))
+        self.assertEqual(r.status_code, 404)
+        r = requests.get(self.url("/test_version?diff=v1,HEAD"))
+        self.assertEqual(r.status_code, 200)
+
+    def test_snapshot(self):
+        r = requests.post(self.url("/test_snapshot/page?edit"), data={
+            "body": "as of snapshot"
+        })
+        self.assertGreaterEqual(r.status_code, 200)
+        self.assertLess(r.status_code, 300)
+
+        r = requests.post(self.url("/?snapshots"), data={
+            "title": "Q3 handbook"
+        }, allow_redirects=False)
+        self.assertEqual(r.status_code, 302)
+        tag = subprocess.check_output(["git", "-C", self.cwd, "cat-file", "-p", "Q3-handbook"])
+        self.assertIn("Q3 handbook", tag)
+        self.assertIn("tagger anonymous@", tag)
+
+        r = requests.post(self.url("/?snapshots"), data={
+            "title": "Q3 handbook"
+        })
+        self.assertEqual(r.status_code, 409)
+        r = requests.post(self.url("/?snapshots"), data={
+            "title": "bad", "name": "bad..name"
+        })
+        self.assertEqual(r.status_code, 400)
+
+        r = requests.get(self.url("/?snapshots"))
+        self.assertIn("Q3 handbook", r.text)
+        self.assertIn("?version=Q3-handbook", r.text)
+
+        # later changes do not show up in the snapshot
+        r = requests.post(self.url("/test_snapshot/page?edit"), data={
+            "body": "changed later"
+        })
+        r = requests.post(self.url("/test_snapshot/later?edit"), data={
+            "body": "added later"
+        })
+        r = requests.get(self.url("/test_snapshot/page?version=Q3-handbook"))
+        self.assertIn("as of snapshot", r.text)
+        r = requests.get(self.url("/test_snapshot?version=Q3-handbook"), allow_redirects=False)
+        self.assertEqual(r.status_code, 307)
+        r = requests.get(self.url("/test_snapshot/?version=Q3-handbook"))
+        self.assertEqual(r.status_code, 200)
+        self.assertIn("/test_snapshot/page?version=Q3-handbook", r.text)
+        self.assertNotIn("later", r.text)
+        r = requests.get(self.url("/test_snapshot/later?version=Q3-handbook"))
+        self.assertEqual(r.status_code, 404)
+
+    def test_recent_changes(self):
+        for fp in ["test_changes/a", "test_changes/b", "test_changes_other"]:
+            r = requests.post(self.url("/%s?edit" % fp), data={
+                "body": "content of " + fp
+            })
+            self.assertGreaterEqual(r.status_code, 200)
+            self.assertLess(r.status_code, 300)
+
+        r = requests.get(self.url("/?changes"))
+        self.assertEqual(r.status_code, 200)
+        self.assertIn("test_changes/a.md", r.text)
+        self.assertIn("test_changes_other.md", r.text)
+        # the latest first
+        self.assertLess(r.text.index("test_changes_other.md"), r.text.index("test_changes/a.md"))
+
+        r = requests.get(self.url("/test_changes/?changes"))
+        self.assertIn("test_changes/b.md", r.text)
+        self.assertNotIn("test_changes_other.md", r.text)
+        r = requests.get(self.url("/test_changes/?changes=1"))
+        self.assertIn("test_changes/b.md", r.text)
+        self.assertNotIn("test_changes/a.md", r.text)
+
+        r = requests.get(self.url("/?changes&author=anonymous"))
+        self.assertIn("test_changes/a.md", r.text)
+        r = requests.get(self.url("/?changes&author=nobody"))
+        self.assertNotIn("test_changes/a.md", r.text)
+
+        r = requests.get(self.url("/test_changes/?changes&feed=atom"))
+        self.assertEqual(r.status_code, 200)
+        self.assertIn("application/atom+xml", r.headers["Content-Type"])
+        self.assertIn('<feed xmlns="http://www.w3.org/2005/Atom">', r.text)
+        self.assertIn("/test_changes/a?version=", r.text)
+        self.assertNotIn("test_changes_other", r.text)
+
+        r = requests.get(self.url("/?changes&feed=rss"))
+        self.assertEqual(r.status_code, 200)
+        self.assertIn("application/rss+xml", r.headers["Content-Type"])
+        self.assertIn('<rss version="2.0">', r.text)
+        self.assertIn("upload to test_changes_other.md", r.text)
+
+        r = requests.get(self.url("/?changes&feed=json"))
+        self.assertEqual(r.status_code, 400)
+
+    def test_diff_modes(self):
+        for body in ["# title\n\nthe quick brown fox\n", "# title\n\nthe quick red fox\n"]:
+            r = requests.post(self.url("/test_diffmode?edit"), data={
+                "body": body
+            })
+            self.assertGreaterEqual(r.status_code, 200)
+            self.assertLess(r.status_code, 300)
+
+        for mode in ["unified", "side-by-side", "words", "rendered"]:
+            r = requests.get(self.url("/test_diffmode?diff=HEAD~1,HEAD&diffmode=%s" % mode))
+            self.assertEqual(r.status_code, 200, mode)
+            self.assertIn("red", r.text, mode)
+            self.assertIn("brown", r.text, mode)
+        r = requests.get(self.url("/test_diffmode?diff=HEAD~1,HEAD&diffmode=words"))
+        self.assertIn("<del>brown</del>", r.text)
+        self.assertIn("<ins>red</ins>", r.text)
+        r = requests.get(self.url("/test_diffmode?diff=HEAD~1,HEAD&diffmode=rendered"))
+        self.assertIn("<del>brown</del>", r.text)
+        self.assertIn("# title", r.text)
+
+        r = requests.get(self.url("/test_diffmode?diff=HEAD~1,HEAD&diffmode=fancy"))
+        self.assertEqual(r.status_code, 400)
+
+    def test_commit_view(self):
+        r = requests.post(self.url("/test_commit_view?edit"), data={
+            "body": "line one\nline two\n"
+        })
+        self.assertLess(r.status_code, 400)
+        # two files in one external commit
+        with open(os.path.join(self.cwd, "test_commit_view.md"), "w") as f:
+            f.write("line one\nline 2\nline three\n")
+        with open(os.path.join(self.cwd, "test_commit_other.md"), "w") as f:
+            f.write("another file\n")
+        git = ["git", "-C", self.cwd]
+        subprocess.check_call(git + ["add", "test_commit_view.md", "test_commit_other.md"])
+        subprocess.check_call(git + ["commit", "-q", "-m", "two files at once"])
+        sha = subprocess.check_output(git + ["rev-parse", "HEAD"]).strip()
+
+        r = requests.get(self.url("/?commit=%s" % sha[:7]))
+        self.assertEqual(r.status_code, 200)
+        self.assertIn("two files at once", r.text)
+        self.assertIn(sha, r.text)
+        self.assertIn("test_commit_view.md", r.text)
+        self.assertIn("test_commit_other.md", r.text)
+        self.assertIn("+2", r.text)
+        self.assertIn("-1", r.text)
+        self.assertIn("line three", r.text)
+        self.assertIn("/test_commit_other?version=%s" % sha, r.text)
+
+        # the latest commit by default
+        r = requests.get(self.url("/?commit"))
+        self.assertEqual(r.status_code, 200)
+        self.assertIn("two files at once", r.text)
+
+        r = requests.get(self.url("/?commit=nosuchcommit"))
+        self.assertEqual(r.status_code, 404)
+
+    def test_commit_message(self):
+        r = requests.post(self.url("/test_message?edit"), data={
+            "body": "first", "message": "start the page"
+        })
+        self.assertLess(r.status_code, 400)
+        r = requests.post(self.url("/test_message?edit"), data={
+            "body": "first, typo fixed", "minor": "1"
+        })
+        self.assertLess(r.status_code, 400)
+        r = requests.post(self.url("/test_message?edit"), json={
+            "body": "second", "message": "rewrite the page"
+        })
+        self.assertLess(r.status_code, 400)
+        r = requests.post(self.url("/test_message?edit"), json={
+            "body": "second, typo fixed", "message": "typo", "minor": True
+        })
+        self.assertLess(r.status_code, 400)
+        self.assertEqual(requests.get(self.url("/test_message.md")).text, "second, typo fixed")
+
+        git = ["git", "-C", self.cwd]
+        log = subprocess.check_output(git + ["log", "-4", "--format=%B%x00"]).split("\0")
+        self.assertEqual(log[0].strip(), "typo\n\nMinor-edit: yes")
+        self.assertEqual(log[1].strip(), "rewrite the page")
+        self.assertEqual(log[2].strip(), "update test_message.md\n\nMinor-edit: yes")
+        self.assertEqual(log[3].strip(), "start the page")
+
+        r = requests.get(self.url("/test_message?history"))
+        self.assertIn("start the page", r.text)
+        self.assertIn("rewrite the page", r.text)
+        self.assertIn("update test_message.md", r.text)
+        self.assertNotIn("Minor-edit", r.text)
+        # the latest version stays even if minor
+        r = requests.get(self.url("/test_message?history&hideminor"))
+        self.assertIn("start the page", r.text)
+        self.assertIn("typo", r.text)
+        self.assertNotIn("update test_message.md", r.text)
+
+        r = requests.get(self.url("/?changes&hideminor"))
+        self.assertIn("rewrite the page", r.text)
+        self.assertNotIn("update test_message.md", r.text)
+        r = requests.get(self.url("/?changes"))
+        self.assertIn("update test_message.md", r.text)
+
+        r = requests.post(self.url("/test_message?edit"), data="{bad json",
+                          headers={"Content-Type": "application/json"})
+        self.assertEqual(r.status_code, 400)
+
+    def test_upload_archive(self):
+        git = ["git", "-C", self.cwd]
+        count = int(subprocess.check_output(git + ["rev-list", "--count", "HEAD"]))
+
+        buf = io.BytesIO()
+        with zipfile.ZipFile(buf, "w") as z:
+            z.writestr("a.md", "page a")
+            z.writestr("sub/b.md", "page b")
+            z.writestr("sub/image.txt", "not a page")
+        r = requests.post(self.url("/test_archive/?upload=archive"), files={"body": ("docs.zip", buf.getvalue())})
+        self.assertEqual(r.status_code, 200, r.text)
+        self.assertEqual(r.text, "success")
+        self.assertEqual(int(subprocess.check_output(git + ["rev-list", "--count", "HEAD"])), count + 1)
+        self.assertEqual(requests.get(self.url("/test_archive/sub/b.md")).text, "page b")
+        self.assertEqual(open(os.path.join(self.cwd, "test_archive", "a.md")).read(), "page a")
+
+        buf = io.BytesIO()
+        with tarfile.open(fileobj=buf, mode="w:gz") as t:
+            for name, content in [("a.md", "page a again"), ("c.md", "page c")]:
+                info = tarfile.TarInfo(name)
+                info.size = len(content)
+                t.addfile(info, io.BytesIO(content))
+        r = requests.post(self.url("/test_archive/?upload=archive"), files={"body": ("docs.tar.gz", buf.getvalue())},
+                          data={"message": "import docs"})
+        self.assertEqual(r.status_code, 200, r.text)
+        self.assertEqual(requests.get(self.url("/test_archive/a.md")).text, "page a again")
+        self.assertEqual(subprocess.check_output(git + ["log", "-1", "--format=%s"]).strip(), "import docs")
+
+        # uncommitted changes in the working tree are never overwritten, and nothing is committed
+        head = subprocess.check_output(git + ["rev-parse", "HEAD"]).strip()
+        self.writefile("test_archive/c.md", "local change")
+        buf = io.BytesIO()
+        with zipfile.ZipFile(buf, "w") as z:
+            z.writestr("c.md", "page c again")
+            z.writestr("d.md", "page d")
+        r = requests.post(self.url("/test_archive/?upload=archive"), files={"body": ("docs.zip", buf.getvalue())})
+        self.assertEqual(r.status_code, 409, r.text)
+        self.assertEqual(subprocess.check_output(git + ["rev-parse", "HEAD"]).strip(), head)
+        self.assertEqual(self.readfile("test_archive/c.md"), "local change")
+        self.assertFalse(os.path.exists(os.path.join(self.cwd, "test_archive", "d.md")))
+        subprocess.check_call(git + ["checkout", "--", "test_archive/c.md"])
+
+        # any bad entry fails the whole archive
+        for bad in ["../escape.md", "/abs.md", ".git/config", "sub/.git/hooks/x", "_static/x.js", "bad.md"]:
+            buf = io.BytesIO()
+            with zipfile.ZipFile(buf, "w") as z:
+                z.writestr("good.md", "good")
+                z.writestr(bad, "</xmp>" if bad == "bad.md" else "bad")
+            r = requests.post(self.url("/test_archive_bad/?upload=archive"), files={"body": ("bad.zip", buf.getvalue())})
+            self.assertEqual(r.status_code, 400, bad)
+            self.assertFalse(os.path.exists(os.path.join(self.cwd, "test_archive_bad")), bad)
+
+        r = requests.post(self.url("/test_archive_bad/?upload=archive"), files={"body": ("x.zip", "not an archive")})
+        self.assertEqual(r.status_code, 400)
+
+    def test_commit_author(self):
+        git = ["git", "-C", self.cwd]
+        r = requests.post(self.url("/test_author?edit"), data={"body": "by nobody"})
+        self.assertLess(r.status_code, 400)
+        author = subprocess.check_output(git + ["log", "-1", "--format=%an <%ae>"]).strip()
+        self.assertEqual(author, "anonymous@127.0.0.1 <strapdown@gmail.com>")
+
+        self.writefile(".htpasswd", "alice:{SHA}%s\nbob:{SHA}%s\n" % (
+            base64.b64encode(hashlib.sha1("alicepw").digest()), base64.b64encode(hashlib.sha1("bobpw").digest())))
+        self.writefile(".users", "# the user directory\nalice: Alice Liddell <alice@example.com>\n")
+        self.restart(["-author_ip=false"])
+
+        r = requests.post(self.url("/test_author?edit"), data={"body": "by alice"}, auth=("alice", "alicepw"))
+        self.assertLess(r.status_code, 400)
+        author = subprocess.check_output(git + ["log", "-1", "--format=%an <%ae>"]).strip()
+        self.assertEqual(author, "Alice Liddell <alice@example.com>")
+
+        # not in the user directory
+        r = requests.post(self.url("/test_author?edit"), data={"body": "by bob"}, auth=("bob", "bobpw"))
+        self.assertLess(r.status_code, 400)
+        author = subprocess.check_output(git + ["log", "-1", "--format=%an <%ae>"]).strip()
+        self.assertEqual(author, "bob <strapdown@gmail.com>")
+
+        r = requests.get(self.url("/.users"), auth=("alice", "alicepw"))
+        self.assertEqual(r.status_code, 403)
+
+    def test_download_archive(self):
+        for fp, body in [("test_download/a", "version one"), ("test_download/sub/b", "page b")]:
+            r = requests.post(self.url("/%s?edit" % fp), data={"body": body})
+            self.assertLess(r.status_code, 400)
+        r = requests.post(self.url("/test_download/a?edit"), data={"body": "version two"})
+        self.assertLess(r.status_code, 400)
+        # not committed, should not be in the archive
+        self.writefile("test_download/untracked.md", "untracked")
+        self.writefile(".htpasswd", "")
+
+        r = requests.get(self.url("/test_download/?archive=zip"))
+        self.assertEqual(r.status_code, 200)
+        self.assertEqual(r.headers["Content-Type"], "application/zip")
+        self.assertIn("attachment", r.headers["Content-Disposition"])
+        z = zipfile.ZipFile(io.BytesIO(r.content))
+        names = sorted(z.namelist())
+        self.assertEqual(len(names), 2, names)
+        self.assertTrue(names[0].endswith("/a.md"))
+        self.assertTrue(names[1].endswith("/sub/b.md"))
+        self.assertEqual(z.read(names[0]), "version two")
+
+        r = requests.get(self.url("/test_download?archive=tar.gz&version=HEAD~1"))
+        self.assertEqual(r.status_code, 200)
+        t = tarfile.open(fileobj=io.BytesIO(r.content), mode="r:gz")
+        members = dict((m.name.split("/", 1)[1], m) for m in t.getmembers())
+        self.assertEqual(sorted(members.keys()), ["a.md", "sub/b.md"])
+        self.assertEqual(t.extractfile(members["a.md"]).read(), "version one")
+
+        git = ["git", "-C", self.cwd]
+        subprocess.check_call(git + ["add", "-f", ".htpasswd"])
+        subprocess.check_call(git + ["commit", "-q", "-m", "password file"])
+        r = requests.get(self.url("/?archive"))
+        self.assertEqual(r.status_code, 200)
+        names = zipfile.ZipFile(io.BytesIO(r.content)).namelist()
+        self.assertIn("test_download/a.md", [n.split("/", 1)[1] for n in names])
+        self.assertNotIn(".htpasswd", [n.split("/", 1)[1] for n in names])
+
+        r = requests.get(self.url("/test_download/a.md?archive=zip"))
+        self.assertEqual(r.status_code, 404)
+        r = requests.get(self.url("/?archive=rar"))
+        self.assertEqual(r.status_code, 400)
+
+    def test_export(self):
+        pages = [
+            ("test_export/a", "# Page A\n\n[to b](b) [to c](/test_export/sub/c#top) [raw](image.png) [ext](http://example.com/x)\n"),
+            ("test_export/b", "# Page B\n\n[back](./a?history)\n"),
+            ("test_export/sub/c", "# Page C\n\n[up](../a)\n\n[ref]: /test_export/b\n"),
+        ]
+        for fp, body in pages:
+            r = requests.post(self.url("/%s?edit" % fp), data={"body": body})
+            self.assertLess(r.status_code, 400)
+        r = requests.post(self.url("/test_export/image.png?upload"), files={"body": ("image.png", "PNG")})
+        self.assertLess(r.status_code, 400)
+        r = requests.post(self.url("/test_export/b?option"), json={
+            "Title": "Custom Title", "Toc": "false", "HeadingNumber": "false", "Theme": "", "Host": ""
+        })
+        self.assertLess(r.status_code, 400)
+        r = requests.post(self.url("/test_export/a?edit"), data={"body": "# Page A changed\n"})
+        self.assertLess(r.status_code, 400)
+
+        out = tempfile.mkdtemp()
+        tmpfolders.append(out)
+        subprocess.check_call(["./" + self.binary, "-dir=" + self.cwd, "-export=" + out, "-export_version=HEAD~1"])
+
+        a = open(os.path.join(out, "test_export", "a.html")).read()
+        self.assertIn("# Page A\n", a)
+        self.assertIn("[to b](b.html)", a)
+        self.assertIn("[to c](sub/c.html#top)", a)
+        self.assertIn("[raw](image.png)", a)
+        self.assertIn("[ext](http://example.com/x)", a)
+        self.assertIn('src="../_static/strapdown.min.js"', a)
+        self.assertNotIn('edit="true"', a)
+        b = open(os.path.join(out, "test_export", "b.html")).read()
+        self.assertIn("<title>Custom Title</title>", b)
+        self.assertIn("[back](a.html)", b)
+        c = open(os.path.join(out, "test_export", "sub", "c.html")).read()
+        self.assertIn("[up](../a.html)", c)
+        self.assertIn("[ref]: ../b.html", c)
+        self.assertTrue(os.path.exists(os.path.join(out, "_static", "strapdown.min.js")))
+        self.assertEqual(open(os.path.join(out, "test_export", "image.png")).read(), "PNG")
+        self.assertFalse(os.path.exists(os.path.join(out, "test_export", "b.md.option.json")))
+
+    def test_import(self):
+        dump = tempfile.mkdtemp()
+        tmpfolders.append(dump)
+        with open(os.path.join(dump, "dump.xml"), "w") as f:
+            f.write("""<mediawiki xmlns="http://www.mediawiki.org/xml/export-0.10/">
+  <page>
+    <title>Test Import:Main Page</title>
+    <revision>
+      <timestamp>2010-01-02T03:04:05Z</timestamp>
+      <contributor><username>Alice</username></contributor>
+      <comment>first version</comment>
+      <text>== Hello ==
+'''bold''' and ''italic'' [[Test Import:Other|other]]
+* item</text>
+    </revision>
+    <revision>
+      <timestamp>2010-01-03T03:04:05Z</timestamp>
+      <contributor><ip>10.0.0.1</ip></contributor>
+      <minor/>
+      <text>== Hello ==
+typo fixed</text>
+    </revision>
+  </page>
+  <page>
+    <title>Test Import:Code</title>
+    <revision>
+      <timestamp>2010-01-01T03:04:05Z</timestamp>
+      <contributor><username>Alice</username></contributor>
+      <text>&lt;pre&gt;
+# install deps
+* not a list '''not bold'''
+&lt;/pre&gt;
+''italic'' &lt;code&gt;''quoted''&lt;/code&gt;</text>
+    </revision>
+  </page>
+  <page>
+    <title>Test Import:Xmp</title>
+    <revision>
+      <timestamp>2010-01-04T03:04:05Z</timestamp>
+      <contributor><username>Alice</username></contributor>
+      <text>&lt;/xmp&gt;&lt;script&gt;alert(1)&lt;/script&gt;</text>
+    </revision>
+  </page>
+</mediawiki>
+""")
+        subprocess.check_call(["./" + self.binary, "-dir=" + self.cwd, "-import=" + os.path.join(dump, "dump.xml")])
+
+        git = ["git", "-C", self.cwd]
+        log = subprocess.check_output(git + ["log", "--format=%an|%at|%s", "--", "Test_Import/Main_Page.md"])
+        self.assertEqual(log.strip().split("\n"), [
+            "10.0.0.1|1262487845|import Test_Import/Main_Page.md from mediawiki",
+            "Alice|1262401445|first version",
+        ])
+        self.assertIn("Minor-edit: yes", subprocess.check_output(git + ["log", "-1", "--format=%B"]))
+        content = subprocess.check_output(git + ["show", "HEAD~1:Test_Import/Main_Page.md"])
+        self.assertEqual(content, "## Hello\n**bold** and *italic* [other](/Test_Import/Other)\n- item")
+        # code is kept as it is
+        content = subprocess.check_output(git + ["show", "HEAD:Test_Import/Code.md"])
+        self.assertEqual(content, "```\n# install deps\n* not a list '''not bold'''\n```\n*italic* `''quoted''`")
+        # a page which could not be rendered is skipped
+        self.assertEqual(subprocess.check_output(git + ["log", "--format=%s", "--", "Test_Import/Xmp.md"]), "")
+        self.assertFalse(os.path.exists(os.path.join(self.cwd, "Test_Import", "Xmp.md")))
+
+        data = os.path.join(dump, "dokuwiki", "data")
+        for d in ["pages", "meta", "attic"]:
+            os.makedirs(os.path.join(data, d, "test_import"))
+        with open(os.path.join(data, "meta", "test_import", "doku.changes"), "w") as f:
+            f.write("1262401445\t10.0.0.2\tC\ttest_import:doku\tbob\tcreated\t\n")
+            f.write("1262487845\t10.0.0.2\tD\ttest_import:doku\tbob\tremoved\t\n")
+        with open(os.path.join(data, "attic", "test_import", "doku.1262401445.txt"), "w") as f:
+            f.write("====== Doku ======\n//italic// [[wiki:syntax|syntax]]\n")
+        with open(os.path.join(data, "meta", "test_import", "code.changes"), "w") as f:
+            f.write("1262300000\t10.0.0.2\tC\ttest_import:code\tbob\tcreated\t\n")
+        with open(os.path.join(data, "attic", "test_import", "code.1262300000.txt"), "w") as f:
+            f.write("<code bash>\n  * a // b // c\n== not a heading ==\n</code>\n//italic//\n")
+        subprocess.check_call(["./" + self.binary, "-dir=" + self.cwd, "-import=" + os.path.join(dump, "dokuwiki")])
+
+        log = subprocess.check_output(git + ["log", "--format=%an|%at|%s", "--", "test_import/doku.md"])
+        self.assertEqual(log.strip().split("\n"), ["bob|1262487845|removed", "bob|1262401445|created"])
+        content = subprocess.check_output(git + ["show", "HEAD~1:test_import/doku.md"])
+        self.assertEqual(content, "# Doku\n*italic* [syntax](/wiki/syntax)\n")
+        self.assertFalse(os.path.exists(os.path.join(self.cwd, "test_import", "doku.md")))
+        self.assertEqual(self.readfile("test_import/code.md"), "```bash\n  * a // b // c\n== not a heading ==\n```\n*italic*\n")
+
+    def test_deleted_restore(self):
+        r = requests.post(self.url("/test_deleted/a?edit"), data={"body": "# version 1\n"})
+        self.assertLess(r.status_code, 400)
+        r = requests.post(self.url("/test_deleted/a?edit"), data={"body": "# version 2\n"})
+        self.assertLess(r.status_code, 400)
+        r = requests.post(self.url("/test_deleted/b?edit"), data={"body": "# kept\n"})
+        self.assertLess(r.status_code, 400)
+        r = requests.post(self.url("/test_deleted/c?edit"), data={"body": "# moved\n"})
+        self.assertLess(r.status_code, 400)
+        r = requests.post(self.url("/test_deleted/c.md?move=test_deleted/d"))
+        self.assertLess(r.status_code, 400)
+        r = requests.delete(self.url("/test_deleted/a.md?delete"))
+        self.assertEqual(r.status_code, 200)
+
+        for u in ["/?deleted", "/test_deleted/?deleted"]:
+            r = requests.get(self.url(u))
+            self.assertEqual(r.status_code, 200)
+            self.assertIn("test_deleted/a.md", r.text)
+            self.assertIn("delete test_deleted/a.md", r.text)
+            self.assertNotIn("test_deleted/b.md", r.text)
+            # moved pages are not lost
+            self.assertNotIn("test_deleted/c.md", r.text)
+        r = requests.get(self.url("/test_other/?deleted"))
+        self.assertEqual(r.status_code, 200)
+        self.assertNotIn("test_deleted/a.md", r.text)
+        r = requests.post(self.url("/?deleted"))
+        self.assertEqual(r.status_code, 400)
+
+        r = requests.get(self.url("/test_deleted/a?restore"))
+        self.assertEqual(r.status_code, 400)
+        r = requests.post(self.url("/test_deleted/b.md?restore"))
+        self.assertEqual(r.status_code, 409)
+        r = requests.post(self.url("/test_deleted/nothing.md?restore"))
+        self.assertEqual(r.status_code, 404)
+
+        r = requests.post(self.url("/test_deleted/a.md?restore"), allow_redirects=False)
+        self.assertEqual(r.status_code, 302)
+        self.assertEqual(r.headers["Location"], "/test_deleted/a")
+        r = requests.get(self.url("/test_deleted/a"))
+        self.assertIn("# version 2", r.text)
+        r = requests.get(self.url("/test_deleted/?deleted"))
+        self.assertNotIn("test_deleted/a.md", r.text)
+
+        # an older version
+        r = requests.delete(self.url("/test_deleted/a.md?delete"))
+        self.assertEqual(r.status_code, 200)
+        first = subprocess.check_output(["git", "-C", self.cwd, "log", "--format=%H", "--", "test_deleted/a.md"]).split()[-1]
+        r = requests.post(self.url("/test_deleted/a?restore=" + first), allow_redirects=False)
+        self.assertEqual(r.status_code, 302)
+        r = requests.get(self.url("/test_deleted/a"))
+        self.assertIn("# version 1", r.text)
+
+        # the head of the page comes back with it, in the same commit
+        r = requests.post(self.url("/test_deleted/e?edit"), data={"body": "# with head\n"})
+        self.assertLess(r.status_code, 400)
+        r = requests.post(self.url("/test_deleted/e.md.head?edit"), data={"body": "head of e"})
+        self.assertLess(r.status_code, 400)
+        r = requests.delete(self.url("/test_deleted/e.md?delete"))
+        self.assertEqual(r.status_code, 200)
+        self.assertFalse(os.path.exists(os.path.join(self.cwd, "test_deleted", "e.md.head")))
+        r = requests.post(self.url("/test_deleted/e.md?restore"), allow_redirects=False)
+        self.assertEqual(r.status_code, 302)
+        self.assertEqual(self.readfile("test_deleted/e.md.head"), "head of e")
+        files = subprocess.check_output(["git", "-C", self.cwd, "show", "--name-only", "--format=", "HEAD"]).split()
+        self.assertEqual(sorted(files), ["test_deleted/e.md", "test_deleted/e.md.head"])
+
+    def test_history_paging(self):
+        for i in range(5):
+            r = requests.post(self.url("/test_paging?edit"), data={"body": "# version %d\n" % i, "message": "version %d" % i})
+            self.assertLess(r.status_code, 400)
+
+        r = requests.get(self.url("/test_paging?history&format=json"))
+        self.assertEqual(r.status_code, 200)
+        self.assertEqual(r.headers["Content-Type"], "application/json")
+        full = r.json()
+        self.assertEqual(full["Path"], "test_paging.md")
+        self.assertEqual([e["Message"] for e in full["Entries"]], ["version %d" % i for i in range(4, -1, -1)])
+        self.assertNotIn("Next", full)
+
+        ids = []
+        after = ""
+        for n in [2, 2, 1]:
+            r = requests.get(self.url("/test_paging?history=2&format=json" + (after and "&after=" + after)))
+            self.assertEqual(r.status_code, 200)
+            page = r.json()
+            self.assertEqual(len(page["Entries"]), n)
+            ids += [e["Id"] for e in page["Entries"]]
+            after = page.get("Next", "")
+        self.assertEqual(after, "")
+        self.assertEqual(ids, [e["Id"] for e in full["Entries"]])
+
+        r = requests.get(self.url("/test_paging?history=2"))
+        self.assertIn("Older versions", r.text)
+        self.assertIn("after=" + ids[1], r.text)
+        r = requests.get(self.url("/test_paging?history=2&after=" + ids[3]))
+        self.assertNotIn("Older versions", r.text)
+        self.assertIn("version 0", r.text)
+        self.assertNotIn("version 4", r.text)
+
+        today = time.strftime("%Y-%m-%d")
+        yesterday = time.strftime("%Y-%m-%d", time.localtime(time.time() - 86400))
+        tomorrow = time.strftime("%Y-%m-%d", time.localtime(time.time() + 86400))
+        for query, count in [("since=" + today, 5), ("since=" + tomorrow, 0), ("until=" + today, 5),
+                             ("until=" + yesterday, 0), ("author=anonymous", 5), ("author=nobody", 0)]:
+            r = requests.get(self.url("/test_paging?history&format=json&" + query))
+            self.assertEqual(r.status_code, 200)
+            self.assertEqual(len(r.json()["Entries"]), count, query)
+        r = requests.get(self.url("/test_paging?history&author=nobody"))
+        self.assertEqual(r.status_code, 200)
+
+        r = requests.get(self.url("/test_paging?history&after=0123456789abcdef"))
+        self.assertEqual(r.status_code, 404)
+        r = requests.get(self.url("/test_paging?history&since=someday"))
+        self.assertEqual(r.status_code, 400)
+        r = requests.get(self.url("/test_paging?history&format=xml"))
+        self.assertEqual(r.status_code, 400)
+
+    def test_path_index(self):
+        for i in range(3):
+            r = requests.post(self.url("/test_index?edit"), data={"body": "# version %d\n" % i, "message": "version %d" % i})
+            self.assertLess(r.status_code, 400)
+        index = os.path.join(self.cwd, ".git", "strapdown-pathindex")
+        self.assertTrue(os.path.exists(index))
+        self.assertIn('"test_index.md"', open(index).read())
+
+        history = lambda fp: [e["Message"] for e in requests.get(self.url(fp + "?history&format=json")).json()["Entries"]]
+        self.assertEqual(history("/test_index"), ["version 2", "version 1", "version 0"])
+        r = requests.get(self.url("/test_index?history=1&format=json&after=HEAD"))
+        self.assertEqual([e["Message"] for e in r.json()["Entries"]], ["version 1"])
+
+        # renames are followed
+        r = requests.post(self.url("/test_index.md?move=test_index_moved&redirect=false"))
+        self.assertLess(r.status_code, 400)
+        r = requests.get(self.url("/test_index_moved?history&format=json"))
+        entries = r.json()["Entries"]
+        self.assertEqual([e["Message"] for e in entries], ["move test_index.md to test_index_moved.md", "version 2", "version 1", "version 0"])
+        self.assertEqual(entries[-1]["OldPath"], "test_index.md")
+
+        # commits made outside of the server are indexed when needed
+        git = ["git", "-C", self.cwd, "-c", "user.name=test", "-c", "user.email=test@example.com"]
+        self.writefile("test_index_moved.md", "# from git\n")
+        subprocess.check_call(git + ["commit", "-q", "-am", "from git"])
+        self.assertEqual(history("/test_index_moved")[:2], ["from git", "move test_index.md to test_index_moved.md"])
+
+        # rewritten history is indexed again
+        subprocess.check_call(git + ["reset", "-q", "--hard", "HEAD~2"])
+        self.assertEqual(history("/test_index"), ["version 2", "version 1", "version 0"])
+        self.restart()
+        self.assertEqual(history("/test_index"), ["version 2", "version 1", "version 0"])
+
+        # listings of a version show the last change of each entry
+        first = subprocess.check_output(["git", "-C", self.cwd, "log", "--reverse", "--format=%H"]).split()[0]
+        r = requests.get(self.url("/?version=HEAD"))
+        self.assertEqual(r.status_code, 200)
+        self.assertIn("test_index.md", r.text)
+        r = requests.get(self.url("/?version=" + first))
+        self.assertEqual(r.status_code, 200)
+
+    def test_mounts(self):
+        mounted = tempfile.mkdtemp()
+        tmpfolders.append(mounted)
+        infra = os.path.join(mounted, "infra")
+        mounts = os.path.join(mounted, "mounts.json")
+        with open(mounts, "w") as f:
+            json.dump([{"Prefix": "/infra/", "Dir": "infra", "Title": "Infra Wiki"}], f)
+        f = open(os.path.join(mounted, "infra.htpasswd"), "w")
+        f.write("alice:{SHA}%s\n" % base64.b64encode(hashlib.sha1("alicepw").digest()))
+        f.close()
+        self.restart(["-mounts=" + mounts])
+
+        r = requests.get(self.url("/infra"), allow_redirects=False)
+        self.assertEqual(r.status_code, 301)
+        self.assertTrue(r.headers["Location"].endswith("/infra/"))
+        r = requests.post(self.url("/infra/test_mount?edit"), data={"body": "# mounted page", "message": "in infra"})
+        self.assertLess(r.status_code, 400)
+        self.assertTrue(os.path.exists(os.path.join(infra, "test_mount.md")))
+        self.assertFalse(os.path.exists(os.path.join(self.cwd, "infra", "test_mount.md")))
+        log = subprocess.check_output(["git", "-C", infra, "log", "--format=%s"])
+        self.assertIn("in infra", log)
+        log = subprocess.check_output(["git", "-C", self.cwd, "log", "--all", "--format=%s"])
+        self.assertNotIn("in infra", log)
+
+        r = requests.get(self.url("/infra/test_mount"))
+        self.assertEqual(r.status_code, 200)
+        self.assertIn("Infra Wiki", r.text)
+        self.assertIn("mounted page", r.text)
+        r = requests.get(self.url("/infra/test_mount?history&format=json"))
+        self.assertEqual([e["Message"] for e in r.json()["Entries"]], ["in infra"])
+        r = requests.get(self.url("/infra/?changes"))
+        self.assertIn('href="/infra/?commit=', r.text)
+        r = requests.get(self.url("/test_mount"))
+        self.assertNotIn("mounted page", r.text)
+
+        # moves redirect within the mount
+        r = requests.post(self.url("/infra/test_mount.md?move=test_mount_moved"), allow_redirects=False)
+        self.assertEqual(r.status_code, 302)
+        self.assertTrue(r.headers["Location"].endswith("/infra/test_mount_moved"))
+        r = requests.get(self.url("/infra/test_mount"), allow_redirects=False)
+        self.assertTrue(r.headers["Location"].endswith("/infra/test_mount_moved"))
+
+        # every mount has its own auth file
+        with open(mounts, "w") as f:
+            json.dump([{"Prefix": "/infra/", "Dir": "infra", "Auth": "../infra.htpasswd"}], f)
+        self.restart(["-mounts=" + mounts])
+        r = requests.get(self.url("/infra/test_mount_moved"))
+        self.assertEqual(r.status_code, 401)
+        r = requests.get(self.url("/infra/test_mount_moved"), auth=("alice", "alicepw"))
+        self.assertEqual(r.status_code, 200)
+        r = requests.get(self.url("/"))
+        self.assertEqual(r.status_code, 200)
+
+        # a mount cannot hide the git repository of the default wiki
+        with open(mounts, "w") as f:
+            json.dump([{"Prefix": "/.git/", "Dir": "infra"}], f)
+        self.proc.terminate()
+        self.proc.wait()
+        p = subprocess.Popen(["./" + self.binary, "-dir=" + self.cwd, "-mounts=" + mounts, "-addr=127.0.0.1:%d" % self.ports[0]])
+        self.assertNotEqual(p.wait(), 0)
+        self.start()
+
+    def test_search(self):
+        pages = [("test_search_title", "# Kubernetes upgrade\n\nsteps to follow\n"),
+                 ("test_search_body", "notes about kubernetes and many other things\n\n" + "more words here\n" * 20),
+                 ("test_search_cjk", u"# 会议记录\n\n讨论了部署方案\n".encode("utf-8")),
+                 ("test_search_other", "nothing to see\n")]
+        for fp, body in pages:
+            r = requests.post(self.url("/%s?edit" % fp), data={"body": body})
+            self.assertLess(r.status_code, 400)
+        # saved in the background
+        index = os.path.join(self.cwd, ".git", "strapdown-searchindex")
+        def saved():
+            for i in range(50):
+                if os.path.exists(index):
+                    return True
+                time.sleep(0.1)
+            return False
+        self.assertTrue(saved())
+
+        search = lambda key: requests.get(self.url("/"), params={"search": key}).json()
+        results = search("kubernetes")
+        self.assertEqual([e["Path"] for e in results], ["/test_search_title", "/test_search_body"])
+        self.assertEqual(results[0]["Title"], "Kubernetes upgrade")
+        self.assertIn("ubernetes", results[1]["Match"])
+        self.assertGreater(results[0]["Score"], results[1]["Score"])
+        # unfinished words and several terms
+        self.assertEqual([e["Path"] for e in search("kuber")], ["/test_search_title", "/test_search_body"])
+        self.assertEqual(search("upgrade kubernetes")[0]["Path"], "/test_search_title")
+        self.assertEqual([e["Path"] for e in search(u"部署")], ["/test_search_cjk"])
+        self.assertEqual(search("nosuchword"), [])
+        self.assertEqual(len(requests.get(self.url("/?search=kubernetes&limit=1")).json()), 1)
+
+        # the index follows edits and deletions
+        r = requests.post(self.url("/test_search_body?edit"), data={"body": "rewritten\n"})
+        self.assertLess(r.status_code, 400)
+        self.assertEqual([e["Path"] for e in search("kubernetes")], ["/test_search_title"])
+        self.assertEqual([e["Path"] for e in search("rewritten")], ["/test_search_body"])
+        r = requests.post(self.url("/test_search_title?delete"))
+        self.assertLess(r.status_code, 400)
+        self.assertEqual(search("kubernetes"), [])
+
+        # and commits made outside of the server
+        git = ["git", "-C", self.cwd, "-c", "user.name=test", "-c", "user.email=test@example.com"]
+        self.writefile("test_search_other.md", "# Outside\n\nkubernetes again\n")
+        subprocess.check_call(git + ["commit", "-q", "-am", "from git"])
+        self.assertEqual([e["Path"] for e in search("kubernetes")], ["/test_search_other"])
+
+        # kept across restarts, and rebuilt if missing
+        self.restart()
+        self.assertEqual([e["Path"] for e in search("kubernetes")], ["/test_search_other"])
+        os.remove(index)
+        self.restart()
+        self.assertEqual([e["Path"] for e in search("rewritten")], ["/test_search_body"])
+        self.assertTrue(saved())
+
 if __name__ == '__main__':
     os.chdir(CWD)
     suite = unittest.TestLoader().loadTestsFromTestCase(Test)
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"github.com/libgit2/git2go"
+	"log"
+	"net/mail"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// commit authors come from the active authentication, the http auth login or the google account
+// the user directory maps logins to real names and emails, one user per line:
+//
+//	# comments and empty lines are ignored
+//	alice: Alice Liddell <alice@example.com>
+//
+// for google accounts, the email address could be used as the login
+
+// the email of anonymous authors, and of http auth users not in the user directory
+const DEFAULT_AUTHOR_EMAIL = "strapdown@gmail.com"
+
+// the name of commits made by the server itself, e.g. merges of the remote
+const DEFAULT_AUTHOR_NAME = "strapdown"
+
+type wikiUser struct {
+	Name  string
+	Email string
+}
+
+// reloaded when the file changes, just like the htpasswd file
+type userDirectory struct {
+	sync.Mutex
+	fp      string // empty if disabled
+	modTime time.Time
+	users   map[string]wikiUser
+}
+
+func (this *userDirectory) Lookup(login string) (wikiUser, bool) {
+	this.Lock()
+	defer this.Unlock()
+	this.reload()
+	user, ok := this.users[strings.ToLower(login)]
+	return user, ok
+}
+
+func (this *userDirectory) reload() {
+	if len(this.fp) == 0 {
+		return
+	}
+	stat, err := os.Stat(this.fp)
+	if err != nil {
+		this.users = nil
+		return
+	}
+	if stat.ModTime().Equal(this.modTime) {
+		return
+	}
+	users, err := loadUsers(this.fp)
+	if err != nil {
+		log.Printf("[ WARN ] cannot load user directory %s: %v", this.fp, err)
+		return
+	}
+	this.modTime = stat.ModTime()
+	this.users = users
+}
+
+func loadUsers(fp string) (map[string]wikiUser, error) {
+	file, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	users := make(map[string]wikiUser)
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			log.Printf("[ WARN ] %s:%d: should be `login: Name <email>`", fp, n)
+			continue
+		}
+		login := strings.ToLower(strings.TrimSpace(line[:i]))
+		addr, err := mail.ParseAddress(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			log.Printf("[ WARN ] %s:%d: %v", fp, n, err)
+			continue
+		}
+		users[login] = wikiUser{Name: addr.Name, Email: addr.Address}
+	}
+	return users, scanner.Err()
+}
+
+// the login of the request, anonymous if not authenticated
+func (this *RequestContext) login() (login string, email string) {
+	login, email = "anonymous", DEFAULT_AUTHOR_EMAIL
+	if len(wikiConfig.googleauth) > 0 && this.gauthStatus {
+		login, email = this.gusername, this.gmailaddr
+	} else if len(this.username) > 0 {
+		login = this.username
+	}
+	return login, email
+}
+
+// the commit author of the request, from the user directory if listed
+func (this *RequestContext) author() (name string, email string) {
+	login, email := this.login()
+	name = login
+	user, ok := this.wiki.users.Lookup(login)
+	if !ok && email != DEFAULT_AUTHOR_EMAIL {
+		user, ok = this.wiki.users.Lookup(email)
+	}
+	if ok {
+		if len(user.Name) > 0 {
+			name = user.Name
+		}
+		email = user.Email
+	}
+	if wikiConfig.authorip {
+		name += "@" + this.ip
+	}
+	return name, email
+}
+
+func (this *RequestContext) authorSignature() *git.Signature {
+	name, email := this.author()
+	return &git.Signature{
+		Name:  name,
+		Email: email,
+		When:  time.Now(),
+	}
+}
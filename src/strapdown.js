@@ -316,7 +316,9 @@ function searchoff() {
 	o.innerHTML="";
 	var xmlhttp;
 	//var sendtxt;
-	sendtxt="/?search="+document.getElementById("searchtxt").value;
+	// the wiki may be mounted under a url prefix
+	var prefix=document.getElementsByTagName('xmp')[0].getAttribute("prefix") || "";
+	sendtxt=prefix+"/?search="+encodeURIComponent(document.getElementById("searchtxt").value);
 	if (window.XMLHttpRequest)
 	{
 		//  IE7+, Firefox, Chrome, Opera, Safari 浏览器执行代码